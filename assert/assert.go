@@ -1,6 +1,10 @@
 package assert
 
-import "fmt"
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
 
 type AssertFunc func() error
 
@@ -12,3 +16,87 @@ func True(condition bool, format string, args ...interface{}) AssertFunc {
 		return nil
 	}
 }
+
+// Equal 使用reflect.DeepEqual比较，失败时在消息后追加期望值与实际值
+func Equal(expected, actual interface{}, format string, args ...interface{}) AssertFunc {
+	return func() error {
+		if !reflect.DeepEqual(expected, actual) {
+			return fmt.Errorf("%s, expected %#v, but got %#v", fmt.Sprintf(format, args...), expected, actual)
+		}
+		return nil
+	}
+}
+
+// Nil 断言v为nil，包括值为nil的指针、map、slice等
+func Nil(v interface{}, format string, args ...interface{}) AssertFunc {
+	return func() error {
+		if !isNil(v) {
+			return fmt.Errorf("%s, expected nil, but got %#v", fmt.Sprintf(format, args...), v)
+		}
+		return nil
+	}
+}
+
+// NotNil 断言v不为nil，见Nil
+func NotNil(v interface{}, format string, args ...interface{}) AssertFunc {
+	return func() error {
+		if isNil(v) {
+			return fmt.Errorf(format, args...)
+		}
+		return nil
+	}
+}
+
+// NoError 断言err为nil，失败时在消息后追加err
+func NoError(err error, format string, args ...interface{}) AssertFunc {
+	return func() error {
+		if err != nil {
+			return fmt.Errorf("%s, %v", fmt.Sprintf(format, args...), err)
+		}
+		return nil
+	}
+}
+
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// Errors 多个断言失败的错误
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// All 依次执行所有断言，全部通过时返回nil，否则返回包含所有失败的Errors
+func All(fns ...AssertFunc) error {
+	var errs Errors
+	for _, fn := range fns {
+		if err := fn(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Must 依次执行所有断言，存在失败时以包含所有失败的消息panic，用于启动时校验配置等无法恢复的场景
+func Must(fns ...AssertFunc) {
+	if err := All(fns...); err != nil {
+		panic(err.Error())
+	}
+}
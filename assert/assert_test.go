@@ -0,0 +1,86 @@
+package assert
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAll(t *testing.T) {
+	name, port, zone := "", 80, "bj"
+	err := All(
+		True(len(name) > 0, "Missing 'Name'"),
+		True(port > 1024, "Bad port %d", port),
+		True(len(zone) > 0, "Missing 'Zone'"),
+	)
+	if err == nil {
+		t.Fatal("All should fail")
+	}
+	if errs, ok := err.(Errors); !ok || len(errs) != 2 {
+		t.Fatalf("Expect 2 errors, but got %#v", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "Missing 'Name'") || !strings.Contains(msg, "Bad port 80") {
+		t.Fatalf("Unexpected error: %s", msg)
+	}
+
+	if err = All(True(true, "never"), True(len(zone) > 0, "Missing 'Zone'")); err != nil {
+		t.Fatalf("All should pass, %v", err)
+	}
+}
+
+func TestHelpers(t *testing.T) {
+	var nilPtr *int
+	var nilMap map[string]int
+	one := 1
+
+	passes := []AssertFunc{
+		Equal([]int{1, 2}, []int{1, 2}, "slice"),
+		Equal(map[string]int{"a": 1}, map[string]int{"a": 1}, "map"),
+		Nil(nil, "nil"),
+		Nil(nilPtr, "nil pointer"),
+		Nil(nilMap, "nil map"),
+		NotNil(&one, "pointer"),
+		NotNil(0, "zero value"),
+		NoError(nil, "no error"),
+	}
+	for i, fn := range passes {
+		if err := fn(); err != nil {
+			t.Fatalf("(%d) Should pass, %v", i, err)
+		}
+	}
+
+	fails := []struct {
+		fn     AssertFunc
+		expect string
+	}{
+		{Equal(1, int64(1), "Bad %s", "count"), "Bad count, expected 1, but got 1"},
+		{Equal("a", "b", "Bad name"), `Bad name, expected "a", but got "b"`},
+		{Nil(&one, "Should be nil"), "Should be nil, expected nil"},
+		{NotNil(nilPtr, "Missing '%s'", "Spec"), "Missing 'Spec'"},
+		{NotNil(nil, "Missing value"), "Missing value"},
+		{NoError(errors.New("timeout"), "Dial failed"), "Dial failed, timeout"},
+	}
+	for i, c := range fails {
+		err := c.fn()
+		if err == nil {
+			t.Fatalf("(%d) Should fail", i)
+		}
+		if !strings.HasPrefix(err.Error(), c.expect) {
+			t.Fatalf("(%d) Unexpected error: %s", i, err.Error())
+		}
+	}
+}
+
+func TestMust(t *testing.T) {
+	Must(True(true, "never"))
+
+	defer func() {
+		r := recover()
+		msg, ok := r.(string)
+		if !ok || !strings.Contains(msg, "Bad port 80") || strings.Contains(msg, "never") {
+			t.Fatalf("Unexpected panic %v", r)
+		}
+	}()
+	Must(True(true, "never"), True(80 > 1024, "Bad port %d", 80))
+	t.Fatal("Must should panic")
+}
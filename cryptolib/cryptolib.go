@@ -18,16 +18,66 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/pbkdf2"
 )
 
 const (
 	TypeXORBase64 byte = 0x01
 	TypeAES128    byte = 0x02
 	TypeAES256    byte = 0x03
+	TypeAESCTR    byte = 0x04
+	TypeAES256GCM byte = 0x05
+	TypeAES256KDF byte = 0x06
+
+	TypeChaCha20Poly1305 byte = 0x07
+	TypeXORBase64URL     byte = 0x08
+)
+
+// PBKDF2Iterations 派生密钥时PBKDF2的迭代次数，取值范围[MinPBKDF2Iterations, MaxPBKDF2Iterations]
+// 迭代次数会写入密文，修改该值不影响已加密数据的解密
+var PBKDF2Iterations = 100000
+
+// 密文中迭代次数的合法范围
+// 迭代次数来自密文，不设上限时构造的密文可以让一次解密耗费大量CPU
+const (
+	MinPBKDF2Iterations = 1000
+	MaxPBKDF2Iterations = 1000000
+)
+
+// saltSize 派生密钥时随机盐的长度
+const saltSize = 16
+
+// ErrAuthFailed 认证加密模式下密文或认证标签校验失败
+var ErrAuthFailed = errors.New("authentication failed")
+
+// ErrIntegrity DecryptAuthenticated校验HMAC失败
+var ErrIntegrity = errors.New("integrity check failed")
+
+// 密文信封格式(当前版本):
+// 1 Byte : 魔数
+// 1 Byte : 版本号
+// 1 Byte : 加密类型
+// N Bytes: 密文
+//
+// 旧版本的信封仅在密文末尾追加1字节的加密类型，Decrypt仅在头部不完整时按旧格式解密
+const (
+	envelopeMagic byte = 0xC5
+
+	EnvelopeVersion byte = 0x01
+
+	envelopeHeaderLen = 3
 )
 
 func Encrypt(key, toEncrypt []byte, encType byte) ([]byte, error) {
@@ -41,14 +91,26 @@ func Encrypt(key, toEncrypt []byte, encType byte) ([]byte, error) {
 		b, err = EncryptWithAES128(key, toEncrypt)
 	case TypeAES256:
 		b, err = EncryptWithAES256(key, toEncrypt)
+	case TypeAESCTR:
+		b, err = EncryptWithAESCTR(key, toEncrypt)
+	case TypeAES256GCM:
+		b, err = EncryptWithAES256GCM(key, toEncrypt)
+	case TypeAES256KDF:
+		b, err = EncryptWithAES256Passphrase(key, toEncrypt)
+	case TypeChaCha20Poly1305:
+		b, err = EncryptWithChaCha20(key, toEncrypt)
+	case TypeXORBase64URL:
+		b, err = EncryptWithXORBase64URL(key, toEncrypt)
 	default:
 		return nil, errors.New("No Encrypt method found")
 	}
 
 	if err == nil {
-		wrap := make([]byte, len(b)+1)
-		wrap[len(b)] = encType
-		copy(wrap, b)
+		wrap := make([]byte, envelopeHeaderLen+len(b))
+		wrap[0] = envelopeMagic
+		wrap[1] = EnvelopeVersion
+		wrap[2] = encType
+		copy(wrap[envelopeHeaderLen:], b)
 		return wrap, nil
 	}
 	return nil, err
@@ -58,16 +120,149 @@ func Decrypt(key, toDecrypt []byte) ([]byte, error) {
 	if len(toDecrypt) < 1 {
 		return nil, errors.New("Bad content to decrypt")
 	}
+	if len(toDecrypt) < envelopeHeaderLen || toDecrypt[0] != envelopeMagic {
+		return decryptLegacy(key, toDecrypt)
+	}
+
+	// 头部完整且加密类型已知时只按信封解密，校验失败直接返回错误
+	// 否则篡改后的认证加密密文可能被当作旧格式的CBC/CTR密文解出错误的明文
+	if toDecrypt[1] == EnvelopeVersion && knownType(toDecrypt[2]) {
+		return decryptEnvelope(key, toDecrypt)
+	}
+
+	b, err := decryptEnvelope(key, toDecrypt)
+	if err != nil {
+		// 旧格式的密文有极小的概率以魔数开头，此时尝试按旧格式解密
+		if legacy, legacyErr := decryptLegacy(key, toDecrypt); legacyErr == nil {
+			return legacy, nil
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+func decryptEnvelope(key, toDecrypt []byte) ([]byte, error) {
+	if v := toDecrypt[1]; v != EnvelopeVersion {
+		return nil, fmt.Errorf("Bad envelope, unsupported version %d", v)
+	}
+	t := toDecrypt[2]
+	if !knownType(t) {
+		return nil, fmt.Errorf("Bad envelope, unknown encrypt type %#x", t)
+	}
+	return decryptWithType(key, toDecrypt[envelopeHeaderLen:], t)
+}
+
+// decryptLegacy 解密旧格式(加密类型位于末尾)的密文
+func decryptLegacy(key, toDecrypt []byte) ([]byte, error) {
 	t := toDecrypt[len(toDecrypt)-1]
+	if !knownType(t) {
+		return nil, errors.New("No Decrypt method found")
+	}
+	return decryptWithType(key, toDecrypt[:len(toDecrypt)-1], t)
+}
+
+func knownType(t byte) bool {
+	switch t {
+	case TypeXORBase64, TypeAES128, TypeAES256, TypeAESCTR, TypeAES256GCM,
+		TypeAES256KDF, TypeChaCha20Poly1305, TypeXORBase64URL:
+		return true
+	}
+	return false
+}
+
+func decryptWithType(key, src []byte, t byte) ([]byte, error) {
 	switch t {
 	case TypeXORBase64:
-		return DecryptWithXORBase64(key, toDecrypt[:len(toDecrypt)-1])
+		return DecryptWithXORBase64(key, src)
 	case TypeAES128:
-		return DecryptWithAES128(key, toDecrypt[:len(toDecrypt)-1])
+		return DecryptWithAES128(key, src)
+	case TypeAES256:
+		return DecryptWithAES256(key, src)
+	case TypeAESCTR:
+		return DecryptWithAESCTR(key, src)
+	case TypeAES256GCM:
+		return DecryptWithAES256GCM(key, src)
+	case TypeAES256KDF:
+		return DecryptWithAES256Passphrase(key, src)
+	case TypeChaCha20Poly1305:
+		return DecryptWithChaCha20(key, src)
+	case TypeXORBase64URL:
+		return DecryptWithXORBase64URL(key, src)
 	}
 	return nil, errors.New("No Decrypt method found")
 }
 
+// EncryptAuthenticated 在Encrypt的结果(含信封头部)之后追加32字节的HMAC-SHA256，
+// 为XORBase64、CBC等本身不具备完整性校验的模式提供篡改检测
+func EncryptAuthenticated(key, plaintext []byte, encType byte) ([]byte, error) {
+	b, err := Encrypt(key, plaintext, encType)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, computeMAC(key, b)...), nil
+}
+
+// DecryptAuthenticated 先以常量时间校验HMAC，校验通过后再解密
+// 校验失败时返回ErrIntegrity
+func DecryptAuthenticated(key, toDecrypt []byte) ([]byte, error) {
+	if len(toDecrypt) < sha256.Size+1 {
+		return nil, ErrIntegrity
+	}
+	payload := toDecrypt[:len(toDecrypt)-sha256.Size]
+	mac := toDecrypt[len(toDecrypt)-sha256.Size:]
+	if !hmac.Equal(mac, computeMAC(key, payload)) {
+		return nil, ErrIntegrity
+	}
+	return Decrypt(key, payload)
+}
+
+// NewMAC 返回HMAC-SHA256，MAC密钥由key派生，避免与加密密钥直接复用
+func NewMAC(key []byte) hash.Hash {
+	kh := hmac.New(sha256.New, key)
+	kh.Write([]byte("cryptolib-hmac"))
+	return hmac.New(sha256.New, kh.Sum(nil))
+}
+
+// computeMAC 计算data的HMAC-SHA256，见NewMAC
+func computeMAC(key, data []byte) []byte {
+	h := NewMAC(key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// GenerateKey 使用crypto/rand生成encType对应长度的随机密钥
+func GenerateKey(encType byte) ([]byte, error) {
+	size, err := keySize(encType)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, size)
+	if _, err = io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// GenerateKeyBase64 与GenerateKey相同，返回base64编码后的密钥，便于写入配置
+func GenerateKeyBase64(encType byte) (string, error) {
+	key, err := GenerateKey(encType)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// keySize 返回encType推荐的密钥长度
+func keySize(encType byte) (int, error) {
+	switch encType {
+	case TypeAES128, TypeXORBase64, TypeXORBase64URL:
+		return 16, nil
+	case TypeAES256, TypeAESCTR, TypeAES256GCM, TypeAES256KDF, TypeChaCha20Poly1305:
+		return 32, nil
+	}
+	return 0, errors.New("Unknown encrypt type")
+}
+
 func EncryptWithAES256(key, src []byte) ([]byte, error) {
 	return aesEncrypt(key, src, 256)
 }
@@ -76,6 +271,48 @@ func DecryptWithAES256(key, src []byte) ([]byte, error) {
 	return aesDecrypt(key, src, 256)
 }
 
+// DeriveKey 使用PBKDF2-SHA256从口令派生指定长度的密钥
+func DeriveKey(passphrase, salt []byte, keyLen int) []byte {
+	return deriveKey(passphrase, salt, PBKDF2Iterations, keyLen)
+}
+
+func deriveKey(passphrase, salt []byte, iter, keyLen int) []byte {
+	return pbkdf2.Key(passphrase, salt, iter, keyLen, sha256.New)
+}
+
+// EncryptWithAES256Passphrase 使用口令派生的密钥进行AES256加密
+// 输出格式: 4字节迭代次数 + 16字节随机盐 + AES256密文
+func EncryptWithAES256Passphrase(passphrase, src []byte) ([]byte, error) {
+	if PBKDF2Iterations < MinPBKDF2Iterations || PBKDF2Iterations > MaxPBKDF2Iterations {
+		return nil, fmt.Errorf("PBKDF2Iterations must be in [%d, %d]", MinPBKDF2Iterations, MaxPBKDF2Iterations)
+	}
+
+	header := make([]byte, 4+saltSize)
+	binary.BigEndian.PutUint32(header[:4], uint32(PBKDF2Iterations))
+	salt := header[4:]
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+
+	b, err := aesEncrypt(deriveKey(passphrase, salt, PBKDF2Iterations, 32), src, 256)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, b...), nil
+}
+
+func DecryptWithAES256Passphrase(passphrase, src []byte) ([]byte, error) {
+	if len(src) < 4+saltSize {
+		return nil, errors.New("Content to decrypt to short")
+	}
+	iter := int64(binary.BigEndian.Uint32(src[:4]))
+	if iter < MinPBKDF2Iterations || iter > MaxPBKDF2Iterations {
+		return nil, fmt.Errorf("Bad PBKDF2 iterations %d", iter)
+	}
+	salt := src[4 : 4+saltSize]
+	return aesDecrypt(deriveKey(passphrase, salt, int(iter), 32), src[4+saltSize:], 256)
+}
+
 func EncryptWithAES128(key, src []byte) ([]byte, error) {
 	return aesEncrypt(key, src, 128)
 }
@@ -84,6 +321,157 @@ func DecryptWithAES128(key, src []byte) ([]byte, error) {
 	return aesDecrypt(key, src, 128)
 }
 
+// EncryptWithAES256GCM 使用AES256-GCM认证加密，密文头部为12字节的随机nonce
+// 密文被篡改时解密将返回ErrAuthFailed
+func EncryptWithAES256GCM(key, src []byte) ([]byte, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(src)+aead.Overhead())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, src, nil), nil
+}
+
+func DecryptWithAES256GCM(key, src []byte) ([]byte, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(src) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("Content to decrypt to short")
+	}
+
+	nonce := src[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, src[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	return plaintext, nil
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := newAESCipher(key, 256)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptWithChaCha20 使用XChaCha20-Poly1305认证加密，密文头部为24字节的随机nonce
+// 在没有AES硬件加速的平台(如部分ARM设备)上比AES更快，密文被篡改时解密将返回ErrAuthFailed
+func EncryptWithChaCha20(key, src []byte) ([]byte, error) {
+	aead, err := newXChaCha20(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(src)+aead.Overhead())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, src, nil), nil
+}
+
+func DecryptWithChaCha20(key, src []byte) ([]byte, error) {
+	aead, err := newXChaCha20(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(src) < aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("Content to decrypt to short")
+	}
+
+	nonce := src[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, src[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	return plaintext, nil
+}
+
+func newXChaCha20(key []byte) (cipher.AEAD, error) {
+	k, err := makeKey(key, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.NewX(k)
+}
+
+// EncryptWithAESCTR 使用AES256-CTR模式加密，密文头部为16字节的随机IV
+// CTR模式无需填充且支持从任意偏移处解密(见DecryptWithAESCTRAt)，
+// 但不提供完整性校验，被篡改的密文仍能解出错误的明文，如有需要请额外附加HMAC
+func EncryptWithAESCTR(key, src []byte) ([]byte, error) {
+	block, err := newAESCipher(key, 256)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext := make([]byte, aes.BlockSize+len(src))
+	iv := ciphertext[:aes.BlockSize]
+	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+
+	stream := cipher.NewCTR(block, iv)
+	stream.XORKeyStream(ciphertext[aes.BlockSize:], src)
+	return ciphertext, nil
+}
+
+func DecryptWithAESCTR(key, src []byte) ([]byte, error) {
+	if len(src) < aes.BlockSize {
+		return nil, errors.New("Content to decrypt to short")
+	}
+	return DecryptWithAESCTRAt(key, src[:aes.BlockSize], src[aes.BlockSize:], 0)
+}
+
+// DecryptWithAESCTRAt 解密明文偏移offset处开始的一段密文
+// iv为EncryptWithAESCTR输出头部的16字节，part为去掉IV后从offset处截取的密文片段
+func DecryptWithAESCTRAt(key, iv, part []byte, offset int64) ([]byte, error) {
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("Bad IV size")
+	}
+	if offset < 0 {
+		return nil, errors.New("Offset must be >= 0")
+	}
+
+	block, err := newAESCipher(key, 256)
+	if err != nil {
+		return nil, err
+	}
+
+	// 计数器按块递增，先跳过offset之前的整块，再丢弃块内多余的密钥流
+	counter := make([]byte, aes.BlockSize)
+	copy(counter, iv)
+	carry := uint64(offset / aes.BlockSize)
+	for i := aes.BlockSize - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(counter[i]) + carry&0xFF
+		counter[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+
+	stream := cipher.NewCTR(block, counter)
+	if skip := int(offset % aes.BlockSize); skip > 0 {
+		discard := make([]byte, skip)
+		stream.XORKeyStream(discard, discard)
+	}
+
+	dst := make([]byte, len(part))
+	stream.XORKeyStream(dst, part)
+	return dst, nil
+}
+
+func newAESCipher(key []byte, bit int) (cipher.Block, error) {
+	k, err := makeKey(key, bit/8)
+	if err != nil {
+		return nil, err
+	}
+	return aes.NewCipher(k)
+}
+
 func aesEncrypt(key, src []byte, bit int) ([]byte, error) {
 	// add padding
 	toEncrypt := make([]byte, 0, len(src))
@@ -93,9 +481,7 @@ func aesEncrypt(key, src []byte, bit int) ([]byte, error) {
 		return nil, errors.New("Content to encrypt is not a multiple of the block size")
 	}
 
-	k := make([]byte, 0, 32)
-	k = append(k, key...)
-	block, err := aes.NewCipher(makeKey(k, bit/8))
+	block, err := newAESCipher(key, bit)
 	if err != nil {
 		return nil, err
 	}
@@ -116,9 +502,7 @@ func aesDecrypt(key, src []byte, bit int) ([]byte, error) {
 		return nil, errors.New("Content to decrypt to short")
 	}
 
-	k := make([]byte, 0, 32)
-	k = append(k, key...)
-	block, err := aes.NewCipher(makeKey(k, bit/8))
+	block, err := newAESCipher(key, bit)
 	if err != nil {
 		return nil, err
 	}
@@ -133,55 +517,107 @@ func aesDecrypt(key, src []byte, bit int) ([]byte, error) {
 
 	mode := cipher.NewCBCDecrypter(block, iv)
 	mode.CryptBlocks(toDecrypt, toDecrypt)
-	toDecrypt = PKCS7UnPadding(toDecrypt)
-	return toDecrypt, nil
+	return PKCS7UnPadding(toDecrypt, aes.BlockSize)
 }
 
 // XORBase64
 func EncryptWithXORBase64(key, src []byte) ([]byte, error) {
-	k := make([]byte, 0, len(src))
+	return EncryptWithXORBase64Encoding(key, src, base64.StdEncoding)
+}
+
+func DecryptWithXORBase64(key, src []byte) ([]byte, error) {
+	return DecryptWithXORBase64Encoding(key, src, base64.StdEncoding)
+}
+
+// EncryptWithXORBase64URL 使用URL安全的base64字母表输出，适用于URL和文件名
+func EncryptWithXORBase64URL(key, src []byte) ([]byte, error) {
+	return EncryptWithXORBase64Encoding(key, src, base64.URLEncoding)
+}
+
+func DecryptWithXORBase64URL(key, src []byte) ([]byte, error) {
+	return DecryptWithXORBase64Encoding(key, src, base64.URLEncoding)
+}
+
+// EncryptWithXORBase64Encoding 使用指定的base64字母表(如base64.URLEncoding)输出
+// 解密时必须使用相同的字母表
+func EncryptWithXORBase64Encoding(key, src []byte, enc *base64.Encoding) ([]byte, error) {
+	if enc == nil {
+		return nil, errors.New("Base64 encoding is nil")
+	}
 	tmpSrc := make([]byte, len(src))
-	k = append(k, key...)
-	k = makeKey(k, len(src))
-	for i, b := range src {
-		tmpSrc[i] = k[i] ^ b
+	if err := xorWithKey(tmpSrc, src, key); err != nil {
+		return nil, err
 	}
-	dst := make([]byte, base64.StdEncoding.EncodedLen(len(tmpSrc)))
-	base64.StdEncoding.Encode(dst[:], tmpSrc)
+	dst := make([]byte, enc.EncodedLen(len(tmpSrc)))
+	enc.Encode(dst[:], tmpSrc)
 	return dst, nil
 }
 
-func DecryptWithXORBase64(key, src []byte) ([]byte, error) {
-	dst := make([]byte, base64.StdEncoding.DecodedLen(len(src)))
-	n, err := base64.StdEncoding.Decode(dst, src)
+func DecryptWithXORBase64Encoding(key, src []byte, enc *base64.Encoding) ([]byte, error) {
+	if enc == nil {
+		return nil, errors.New("Base64 encoding is nil")
+	}
+	dst := make([]byte, enc.DecodedLen(len(src)))
+	n, err := enc.Decode(dst, src)
 	if err != nil {
 		return nil, err
 	}
 	dst = dst[:n]
-	k := make([]byte, 0, len(dst))
-	k = append(k, key...)
-	k = makeKey(k, len(dst))
-	for i, b := range dst {
-		dst[i] = k[i] ^ b
+	if err = xorWithKey(dst, dst, key); err != nil {
+		return nil, err
 	}
 	return dst, nil
 }
 
+// xorWithKey 将src与循环重复的key逐字节异或后写入dst
+// 与makeKey的重复方式结果一致，但耗时仅与src长度相关，不会通过耗时泄露key的长度
+func xorWithKey(dst, src, key []byte) error {
+	if len(key) <= 0 {
+		return errors.New("Key is empty")
+	}
+	for i, j := 0, 0; i < len(src); i++ {
+		dst[i] = src[i] ^ key[j]
+		// j到达len(key)时归零，使用掩码代替分支
+		j++
+		j &= -subtle.ConstantTimeEq(int32(j), int32(len(key))) ^ -1
+	}
+	return nil
+}
+
 func PKCS7Padding(ciphertext []byte, blockSize int) []byte {
 	padding := blockSize - len(ciphertext)%blockSize
 	padtext := bytes.Repeat([]byte{byte(padding)}, padding)
 	return append(ciphertext, padtext...)
 }
 
-func PKCS7UnPadding(origData []byte) []byte {
+// PKCS7UnPadding 去除PKCS7填充
+// 填充值必须在[1, blockSize]范围内且所有填充字节一致，否则返回错误
+func PKCS7UnPadding(origData []byte, blockSize int) ([]byte, error) {
 	length := len(origData)
+	if length <= 0 {
+		return nil, errors.New("Bad padding, content is empty")
+	}
 	unpadding := int(origData[length-1])
-	return origData[:(length - unpadding)]
+	if unpadding < 1 || unpadding > blockSize || unpadding > length {
+		return nil, errors.New("Bad padding size")
+	}
+	for _, b := range origData[length-unpadding:] {
+		if int(b) != unpadding {
+			return nil, errors.New("Bad padding content")
+		}
+	}
+	return origData[:(length - unpadding)], nil
 }
 
-func makeKey(key []byte, size int) []byte {
-	for len(key) < size {
-		key = append(key, key...)
+// makeKey 通过重复key的方式补齐到指定长度，返回新的切片，不会修改key
+// Deprecated: 该方式没有任何密钥拉伸，仅为兼容已有数据而保留，新数据请使用DeriveKey
+func makeKey(key []byte, size int) ([]byte, error) {
+	if len(key) <= 0 {
+		return nil, errors.New("Key is empty")
+	}
+	k := make([]byte, size)
+	for i := 0; i < size; i += len(key) {
+		copy(k[i:], key)
 	}
-	return key[0:size]
+	return k, nil
 }
@@ -17,6 +17,9 @@ package cryptolib
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
+	"math/rand"
+	"strings"
 	"testing"
 )
 
@@ -77,3 +80,449 @@ func TestXORBase64(t *testing.T) {
 	}
 	t.Log("Success")
 }
+
+func TestAESCTR(t *testing.T) {
+	encrypted, err := Encrypt(key, toEncrypt, TypeAESCTR)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	decrypted, err := Decrypt(key, encrypted)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if bytes.Equal(decrypted, toEncrypt) == false {
+		t.Fatal("Not Equal")
+	}
+	t.Log("Success")
+}
+
+func TestAESCTRSeek(t *testing.T) {
+	// 足够长以跨越多个块，并覆盖计数器的进位
+	plain := bytes.Repeat(toEncrypt, 100)
+
+	encrypted, err := EncryptWithAESCTR(key, plain)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	iv, body := encrypted[:16], encrypted[16:]
+
+	for _, offset := range []int{0, 1, 15, 16, 17, 100, 1000, len(plain) - 7} {
+		end := offset + 37
+		if end > len(plain) {
+			end = len(plain)
+		}
+		part, err := DecryptWithAESCTRAt(key, iv, body[offset:end], int64(offset))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if bytes.Equal(part, plain[offset:end]) == false {
+			t.Fatalf("Not Equal at offset %d", offset)
+		}
+	}
+
+	// IV末尾为0xFF时，跳块需要正确进位
+	iv = bytes.Repeat([]byte{0xFF}, 16)
+	iv[0] = 0x00
+	full, _ := DecryptWithAESCTRAt(key, iv, body, 0)
+	part, _ := DecryptWithAESCTRAt(key, iv, body[33:], 33)
+	if bytes.Equal(full[33:], part) == false {
+		t.Fatal("Not Equal when counter carries")
+	}
+}
+
+func TestRoundTripAllTypes(t *testing.T) {
+	for _, encType := range []byte{TypeXORBase64, TypeAES128, TypeAES256, TypeAESCTR, TypeAES256GCM, TypeAES256KDF, TypeChaCha20Poly1305, TypeXORBase64URL} {
+		encrypted, err := Encrypt(key, toEncrypt, encType)
+		if err != nil {
+			t.Fatalf("Encrypt with type %#x failed, %v", encType, err)
+		}
+		if encrypted[0] != envelopeMagic || encrypted[1] != EnvelopeVersion || encrypted[2] != encType {
+			t.Fatalf("Bad envelope header %#v for type %#x", encrypted[:3], encType)
+		}
+
+		decrypted, err := Decrypt(key, encrypted)
+		if err != nil {
+			t.Fatalf("Decrypt with type %#x failed, %v", encType, err)
+		}
+		if bytes.Equal(decrypted, toEncrypt) == false {
+			t.Fatalf("Not Equal for type %#x", encType)
+		}
+	}
+}
+
+func TestAES256GCMTampered(t *testing.T) {
+	encrypted, err := Encrypt(key, toEncrypt, TypeAES256GCM)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// 分别篡改nonce、密文、认证标签
+	for _, idx := range []int{envelopeHeaderLen, 20, len(encrypted) - 2} {
+		tampered := append([]byte(nil), encrypted...)
+		tampered[idx] ^= 0x01
+		if _, err = Decrypt(key, tampered); err != ErrAuthFailed {
+			t.Fatalf("Tampered at %d, expect ErrAuthFailed but got %v", idx, err)
+		}
+	}
+}
+
+func TestTamperedNoLegacyFallback(t *testing.T) {
+	for _, encType := range []byte{TypeAES256GCM, TypeChaCha20Poly1305} {
+		encrypted, err := Encrypt(key, toEncrypt, encType)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// 篡改认证标签，并将末尾字节改为旧格式的加密类型
+		for _, legacyType := range []byte{TypeAES128, TypeAES256, TypeAESCTR} {
+			tampered := append([]byte(nil), encrypted...)
+			tampered[len(tampered)-2] ^= 0x01
+			tampered[len(tampered)-1] = legacyType
+			if b, err := Decrypt(key, tampered); err != ErrAuthFailed {
+				t.Fatalf("Type %#x tampered as %#x, expect ErrAuthFailed but got %q, %v", encType, legacyType, b, err)
+			}
+		}
+	}
+}
+
+func TestPKCS7UnPadding(t *testing.T) {
+	padded := PKCS7Padding([]byte("Hello"), 16)
+	b, err := PKCS7UnPadding(padded, 16)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(b) != "Hello" {
+		t.Fatalf("Unpadded %q != Hello", b)
+	}
+
+	bad := map[string][]byte{
+		"zero-length":      {},
+		"all-zero-padding": make([]byte, 16),
+		"over-length":      append(bytes.Repeat([]byte{0x01}, 15), 0x11),
+		"longer-than-data": {0x01, 0x05},
+		"mismatched":       append(bytes.Repeat([]byte{0x01}, 13), 0x02, 0x03, 0x03),
+	}
+	for name, data := range bad {
+		if _, err = PKCS7UnPadding(data, 16); err == nil {
+			t.Fatalf("%s: expect error", name)
+		}
+	}
+
+	// 解密时填充错误应返回错误而不是panic
+	encrypted, err := EncryptWithAES128(key, toEncrypt)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = DecryptWithAES128(key, encrypted[:16]); err == nil {
+		t.Fatal("Decrypt content without blocks should fail")
+	}
+}
+
+func TestAES256Passphrase(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+
+	encrypted, err := EncryptWithAES256Passphrase(passphrase, toEncrypt)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// 修改迭代次数不影响已有数据的解密
+	old := PBKDF2Iterations
+	PBKDF2Iterations = 1000
+	defer func() { PBKDF2Iterations = old }()
+
+	decrypted, err := DecryptWithAES256Passphrase(passphrase, encrypted)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Equal(decrypted, toEncrypt) == false {
+		t.Fatal("Not Equal")
+	}
+
+	// 相同口令每次加密使用不同的盐
+	another, _ := EncryptWithAES256Passphrase(passphrase, toEncrypt)
+	if bytes.Equal(encrypted[4:20], another[4:20]) {
+		t.Fatal("Salt should be random")
+	}
+
+	if len(DeriveKey(passphrase, []byte("salt"), 32)) != 32 {
+		t.Fatal("Bad derived key size")
+	}
+}
+
+func TestAES256PassphraseIterations(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	encrypted, err := EncryptWithAES256Passphrase(passphrase, toEncrypt)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// 拒绝超出范围的迭代次数，避免密文指定过大的迭代次数耗尽CPU
+	for _, iter := range []uint32{0, MinPBKDF2Iterations - 1, MaxPBKDF2Iterations + 1, 1<<32 - 1} {
+		bad := append([]byte(nil), encrypted...)
+		binary.BigEndian.PutUint32(bad[:4], iter)
+		if _, err = DecryptWithAES256Passphrase(passphrase, bad); err == nil || !strings.Contains(err.Error(), "iterations") {
+			t.Fatalf("Iterations %d, expect error but got %v", iter, err)
+		}
+	}
+
+	old := PBKDF2Iterations
+	defer func() { PBKDF2Iterations = old }()
+	for _, iter := range []int{MinPBKDF2Iterations - 1, MaxPBKDF2Iterations + 1} {
+		PBKDF2Iterations = iter
+		if _, err = EncryptWithAES256Passphrase(passphrase, toEncrypt); err == nil {
+			t.Fatalf("Encrypt with iterations %d should fail", iter)
+		}
+	}
+
+	// 边界值可以正常加解密
+	PBKDF2Iterations = MinPBKDF2Iterations
+	encrypted, err = EncryptWithAES256Passphrase(passphrase, toEncrypt)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if decrypted, err := DecryptWithAES256Passphrase(passphrase, encrypted); err != nil || !bytes.Equal(decrypted, toEncrypt) {
+		t.Fatalf("Decrypt with min iterations failed, %v", err)
+	}
+}
+
+func TestAuthenticated(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2018))
+
+	for _, encType := range []byte{TypeXORBase64, TypeAES128, TypeAES256} {
+		encrypted, err := EncryptAuthenticated(key, toEncrypt, encType)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		decrypted, err := DecryptAuthenticated(key, encrypted)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if bytes.Equal(decrypted, toEncrypt) == false {
+			t.Fatal("Not Equal")
+		}
+
+		for i := 0; i < 100; i++ {
+			tampered := append([]byte(nil), encrypted...)
+			tampered[rnd.Intn(len(tampered))] ^= byte(rnd.Intn(255) + 1)
+			if _, err = DecryptAuthenticated(key, tampered); err != ErrIntegrity {
+				t.Fatalf("Type %#x: expect ErrIntegrity, but got %v", encType, err)
+			}
+		}
+
+		if _, err = DecryptAuthenticated([]byte("another key"), encrypted); err != ErrIntegrity {
+			t.Fatalf("Type %#x: expect ErrIntegrity with wrong key, but got %v", encType, err)
+		}
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	for encType, size := range map[byte]int{TypeAES128: 16, TypeAES256: 32, TypeAES256GCM: 32} {
+		k1, err := GenerateKey(encType)
+		if err != nil {
+			t.Fatalf("GenerateKey(%d) failed, %v", encType, err)
+		}
+		k2, err := GenerateKey(encType)
+		if err != nil {
+			t.Fatalf("GenerateKey(%d) failed, %v", encType, err)
+		}
+		if len(k1) != size || len(k2) != size {
+			t.Fatalf("Key length for type %d should be %d, but got %d, %d", encType, size, len(k1), len(k2))
+		}
+		if bytes.Equal(k1, k2) {
+			t.Fatalf("Successive keys for type %d are equal", encType)
+		}
+		if _, err = Encrypt(k1, toEncrypt, encType); err != nil {
+			t.Fatalf("Encrypt with generated key failed, %v", err)
+		}
+	}
+
+	s, err := GenerateKeyBase64(TypeAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, err := base64.StdEncoding.DecodeString(s); err != nil || len(k) != 32 {
+		t.Fatalf("Bad base64 key %q, %v", s, err)
+	}
+
+	if _, err = GenerateKey(0xFF); err == nil {
+		t.Fatal("GenerateKey should fail on unknown type")
+	}
+}
+
+func TestXORBase64URLEncoding(t *testing.T) {
+	// 这些字节与key异或后为0xFB 0xEF 0xFF，在标准base64中会产生'+'和'/'
+	src := []byte{0x98, 0x97, 0x86, 0xDD, 0x8B, 0x85}
+	src = append(src, toEncrypt...)
+
+	std, _ := EncryptWithXORBase64(key, src)
+	if !bytes.Contains(std, []byte("++//")) {
+		t.Fatalf("Standard output should contain '+' and '/': %s", std)
+	}
+
+	encrypted, err := EncryptWithXORBase64Encoding(key, src, base64.URLEncoding)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.ContainsAny(encrypted, "+/") {
+		t.Fatalf("URL-safe output should not contain '+' or '/': %s", encrypted)
+	}
+
+	decrypted, err := DecryptWithXORBase64Encoding(key, encrypted, base64.URLEncoding)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Equal(decrypted, src) == false {
+		t.Fatal("Not Equal")
+	}
+}
+
+func TestChaCha20Tampered(t *testing.T) {
+	encrypted, err := Encrypt(key, toEncrypt, TypeChaCha20Poly1305)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	tampered := append([]byte(nil), encrypted...)
+	tampered[30] ^= 0x01
+	if _, err = Decrypt(key, tampered); err != ErrAuthFailed {
+		t.Fatalf("Expect ErrAuthFailed but got %v", err)
+	}
+}
+
+func benchmarkEncrypt(b *testing.B, f func(key, src []byte) ([]byte, error)) {
+	src := bytes.Repeat(toEncrypt, 1024)
+	b.SetBytes(int64(len(src)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f(key, src); err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+}
+
+func BenchmarkEncryptWithAES256(b *testing.B) {
+	benchmarkEncrypt(b, EncryptWithAES256)
+}
+
+func BenchmarkEncryptWithChaCha20(b *testing.B) {
+	benchmarkEncrypt(b, EncryptWithChaCha20)
+}
+
+func TestLegacyEnvelope(t *testing.T) {
+	for _, encType := range []byte{TypeXORBase64, TypeAES128, TypeAES256} {
+		encrypted, err := Encrypt(key, toEncrypt, encType)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+
+		// 转换为旧格式: 去掉头部，末尾追加加密类型
+		legacy := append(append([]byte(nil), encrypted[envelopeHeaderLen:]...), encType)
+		decrypted, err := Decrypt(key, legacy)
+		if err != nil {
+			t.Fatalf("Decrypt legacy type %#x failed, %v", encType, err)
+		}
+		if bytes.Equal(decrypted, toEncrypt) == false {
+			t.Fatal("Not Equal")
+		}
+	}
+}
+
+func TestEnvelopeErrors(t *testing.T) {
+	encrypted, err := Encrypt(key, toEncrypt, TypeAES256GCM)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	badVersion := append([]byte(nil), encrypted...)
+	badVersion[1] = 0x7F
+	if _, err = Decrypt(key, badVersion); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Fatalf("Expect unsupported version error, but got %v", err)
+	}
+
+	badType := append([]byte(nil), encrypted...)
+	badType[2] = 0x7F
+	if _, err = Decrypt(key, badType); err == nil || !strings.Contains(err.Error(), "unknown encrypt type") {
+		t.Fatalf("Expect unknown type error, but got %v", err)
+	}
+}
+
+func TestXORBase64URL(t *testing.T) {
+	// 这些字节与key异或后为0xFB 0xEF 0xFF，在标准base64中会产生'+'和'/'
+	src := append([]byte{0x98, 0x97, 0x86, 0xDD, 0x8B, 0x85}, toEncrypt...)
+
+	encrypted, err := Encrypt(key, src, TypeXORBase64URL)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.ContainsAny(encrypted[envelopeHeaderLen:], "+/") {
+		t.Fatalf("URL-safe output should not contain '+' or '/': %s", encrypted)
+	}
+
+	decrypted, err := Decrypt(key, encrypted)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Equal(decrypted, src) == false {
+		t.Fatal("Not Equal")
+	}
+}
+
+func TestXORWithKey(t *testing.T) {
+	src := bytes.Repeat([]byte{0x5A}, 100)
+	for _, k := range [][]byte{{0x01}, key, bytes.Repeat(key, 10)} {
+		expect := make([]byte, len(src))
+		mk, err := makeKey(k, len(src))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for i := range src {
+			expect[i] = src[i] ^ mk[i]
+		}
+
+		dst := make([]byte, len(src))
+		if err := xorWithKey(dst, src, k); err != nil {
+			t.Fatal(err.Error())
+		}
+		if bytes.Equal(dst, expect) == false {
+			t.Fatalf("Not Equal with key size %d", len(k))
+		}
+	}
+
+	if _, err := EncryptWithXORBase64(nil, src); err == nil {
+		t.Fatal("Empty key should fail")
+	}
+}
+
+func TestEmptyKey(t *testing.T) {
+	encrypts := map[byte]func(key, src []byte) ([]byte, error){
+		TypeAES128:           EncryptWithAES128,
+		TypeAES256:           EncryptWithAES256,
+		TypeAESCTR:           EncryptWithAESCTR,
+		TypeAES256GCM:        EncryptWithAES256GCM,
+		TypeChaCha20Poly1305: EncryptWithChaCha20,
+	}
+	for encType, encrypt := range encrypts {
+		if _, err := encrypt(nil, toEncrypt); err == nil {
+			t.Fatalf("Encrypt type %#x with empty key should fail", encType)
+		}
+	}
+	if _, err := NewEncryptWriter(nil, bytes.NewBuffer(nil)); err == nil {
+		t.Fatal("NewEncryptWriter with empty key should fail")
+	}
+}
+
+func TestMakeKeyNoAlias(t *testing.T) {
+	buf := make([]byte, 4, 32)
+	copy(buf, key)
+	tail := buf[4:32]
+	if _, err := makeKey(buf, 32); err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Count(tail, []byte{0}) != len(tail) {
+		t.Fatal("makeKey should not write into the caller's backing array")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cryptolib
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// ErrTruncatedIV 流式解密时IV头部不完整
+var ErrTruncatedIV = errors.New("IV header is truncated")
+
+// NewEncryptWriter 返回流式加密的Writer，适用于无法整体载入内存的大文件
+// 使用AES256-CTR模式，输出格式与EncryptWithAESCTR一致(16字节IV + 密文)，
+// 第一次写入时输出IV。CTR模式无需填充，Close时仅在尚未写入任何数据时补写IV，
+// 不会关闭w
+func NewEncryptWriter(key []byte, w io.Writer) (io.WriteCloser, error) {
+	block, err := newAESCipher(key, 256)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		w:  w,
+		iv: iv,
+		sw: &cipher.StreamWriter{S: cipher.NewCTR(block, iv), W: w},
+	}, nil
+}
+
+type encryptWriter struct {
+	w           io.Writer
+	iv          []byte
+	sw          *cipher.StreamWriter
+	wroteHeader bool
+	closed      bool
+}
+
+func (e *encryptWriter) writeHeader() error {
+	if e.wroteHeader {
+		return nil
+	}
+	if _, err := e.w.Write(e.iv); err != nil {
+		return err
+	}
+	e.wroteHeader = true
+	return nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	if e.closed {
+		return 0, errors.New("Write to closed encrypt writer")
+	}
+	if err := e.writeHeader(); err != nil {
+		return 0, err
+	}
+	return e.sw.Write(p)
+}
+
+func (e *encryptWriter) Close() error {
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+	return e.writeHeader()
+}
+
+// NewDecryptReader 返回流式解密的Reader，用于解密NewEncryptWriter或EncryptWithAESCTR的输出
+// 创建时会读取IV头部，IV不完整时返回ErrTruncatedIV。
+// 如果r提前结束，Reader将返回已解密的部分后以io.EOF结束
+func NewDecryptReader(key []byte, r io.Reader) (io.Reader, error) {
+	block, err := newAESCipher(key, 256)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	if _, err = io.ReadFull(r, iv); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrTruncatedIV
+		}
+		return nil, err
+	}
+
+	return &cipher.StreamReader{S: cipher.NewCTR(block, iv), R: r}, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cryptolib
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	plain := bytes.Repeat(toEncrypt, 1000)
+
+	encrypted := bytes.NewBuffer(nil)
+	w, err := NewEncryptWriter(key, encrypted)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// 分多次写入，且每次长度不是块大小的整数倍
+	for i := 0; i < len(plain); i += 1000 {
+		end := i + 1000
+		if end > len(plain) {
+			end = len(plain)
+		}
+		if _, err = w.Write(plain[i:end]); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// 与EncryptWithAESCTR的输出格式兼容
+	decrypted, err := DecryptWithAESCTR(key, encrypted.Bytes())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Equal(decrypted, plain) == false {
+		t.Fatal("Not Equal")
+	}
+
+	r, err := NewDecryptReader(key, bytes.NewReader(encrypted.Bytes()))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	decrypted, err = ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Equal(decrypted, plain) == false {
+		t.Fatal("Not Equal")
+	}
+
+	// 源数据提前结束时返回已解密的部分
+	r, _ = NewDecryptReader(key, io.LimitReader(bytes.NewReader(encrypted.Bytes()), 16+100))
+	decrypted, err = ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if bytes.Equal(decrypted, plain[:100]) == false {
+		t.Fatal("Not Equal for early closed reader")
+	}
+}
+
+func TestStreamEmpty(t *testing.T) {
+	encrypted := bytes.NewBuffer(nil)
+	w, _ := NewEncryptWriter(key, encrypted)
+	if err := w.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if encrypted.Len() != 16 {
+		t.Fatalf("Empty stream should contain IV only, but got %d bytes", encrypted.Len())
+	}
+
+	if _, err := NewDecryptReader(key, bytes.NewReader(encrypted.Bytes()[:10])); err != ErrTruncatedIV {
+		t.Fatalf("Expect ErrTruncatedIV, but got %v", err)
+	}
+	if _, err := NewDecryptReader(key, bytes.NewReader(nil)); err != ErrTruncatedIV {
+		t.Fatalf("Expect ErrTruncatedIV, but got %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encoding
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+
+	"github.com/Hurricanezwf/pkg/internal/gziputil"
+	"github.com/golang/protobuf/proto"
+)
+
+// CompressThreshold EncodeCompressed压缩的最小长度，编码后短于该长度的消息不压缩
+var CompressThreshold = 1024
+
+// 压缩标记，作为EncodeCompressed结果的首字节
+const (
+	markerRaw  byte = 0x00
+	markerGzip byte = 0x01
+)
+
+// EncodeCompressed 编码msg并在超过CompressThreshold时使用gzip压缩，
+// 结果的首字节标识是否压缩，需使用DecodeCompressed解码。压缩后没有变小时保持不压缩
+func EncodeCompressed(method EncodeMethod, msg proto.Message) ([]byte, error) {
+	b, err := Encode(method, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) >= CompressThreshold {
+		compressed, err := gziputil.Compress(b, gzip.DefaultCompression)
+		if err != nil {
+			return nil, fmt.Errorf("Compress msg failed, %v", err)
+		}
+		if len(compressed)+1 < len(b) {
+			return append([]byte{markerGzip}, compressed...), nil
+		}
+	}
+	return append([]byte{markerRaw}, b...), nil
+}
+
+// DecodeCompressed 解码EncodeCompressed的结果
+func DecodeCompressed(method EncodeMethod, b []byte, msg proto.Message) error {
+	if len(b) <= 0 {
+		return errors.New("Empty msg body")
+	}
+
+	switch b[0] {
+	case markerRaw:
+		return Decode(method, b[1:], msg)
+	case markerGzip:
+		raw, err := gziputil.Decompress(b[1:])
+		if err != nil {
+			return fmt.Errorf("Decompress msg failed, %v", err)
+		}
+		return Decode(method, raw, msg)
+	default:
+		return fmt.Errorf("Unknown compression marker 0x%02x", b[0])
+	}
+}
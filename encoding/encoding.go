@@ -16,7 +16,10 @@ package encoding
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"reflect"
 
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
@@ -45,12 +48,40 @@ func DecodeFSMContext(b []byte, ctx proto.Message) error {
 	return Decode(WithPB, b, ctx)
 }
 
+// Options 编码选项，目前仅对WithJSON生效
+type Options struct {
+	// EnumsAsInts 枚举输出为整数而不是名称
+	EnumsAsInts bool
+
+	// EmitDefaults 输出零值字段
+	EmitDefaults bool
+
+	// OrigName 使用proto文件中定义的字段名，而不是lowerCamelCase形式的JSON名
+	OrigName bool
+
+	// Indent 缩进字符串，为空时输出紧凑的单行JSON
+	Indent string
+}
+
+// DefaultOptions 返回Encode使用的编码选项：枚举输出为整数，且输出零值字段
+func DefaultOptions() Options {
+	return Options{
+		EnumsAsInts:  true,
+		EmitDefaults: true,
+	}
+}
+
 func Encode(method EncodeMethod, msg proto.Message) (b []byte, err error) {
+	return EncodeWith(method, msg, DefaultOptions())
+}
+
+// EncodeWith 以指定的编码选项编码msg
+func EncodeWith(method EncodeMethod, msg proto.Message, opts Options) (b []byte, err error) {
 	switch method {
 	case WithPB:
 		b, err = encodeWithPB(msg)
 	case WithJSON:
-		b, err = encodeWithJSON(msg)
+		b, err = encodeWithJSON(msg, opts)
 	default:
 		err = errors.New("Invalid EncodeMethod")
 	}
@@ -73,19 +104,80 @@ func Decode(method EncodeMethod, msgBody []byte, msg proto.Message) (err error)
 	return err
 }
 
+// EncodeSelfDescribing 以自描述的方式编码，读取方无需预先知道消息的具体类型
+// 2 Bytes: 消息全名长度
+// N Bytes: 消息全名, 例如"google.protobuf.StringValue"
+// M Bytes: protobuf编码的消息体
+func EncodeSelfDescribing(msg proto.Message) ([]byte, error) {
+	name := proto.MessageName(msg)
+	if len(name) <= 0 {
+		return nil, errors.New("Unknown proto message name")
+	}
+	if len(name) > 0xFFFF {
+		return nil, errors.New("Proto message name too long")
+	}
+
+	body, err := encodeWithPB(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 2+len(name)+len(body))
+	binary.BigEndian.PutUint16(b[:2], uint16(len(name)))
+	copy(b[2:], name)
+	copy(b[2+len(name):], body)
+	return b, nil
+}
+
+// DecodeSelfDescribing 解码EncodeSelfDescribing的结果
+// 消息类型需已在当前程序的protobuf类型注册表中注册
+func DecodeSelfDescribing(b []byte) (proto.Message, error) {
+	if len(b) < 2 {
+		return nil, errors.New("Self-describing msg too short")
+	}
+	nameLen := int(binary.BigEndian.Uint16(b[:2]))
+	if len(b) < 2+nameLen {
+		return nil, errors.New("Self-describing msg too short")
+	}
+	name := string(b[2 : 2+nameLen])
+
+	t := proto.MessageType(name)
+	if t == nil {
+		return nil, fmt.Errorf("Proto message type '%s' is not registered", name)
+	}
+
+	msg, ok := reflect.New(t.Elem()).Interface().(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("Type '%s' is not a proto message", name)
+	}
+	if err := decodeWithPB(b[2+nameLen:], msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
 func encodeWithPB(msg proto.Message) ([]byte, error) {
-	return proto.Marshal(msg)
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, wrapRequiredNotSet(msg, err)
+	}
+	return b, nil
 }
 
 func decodeWithPB(msgBody []byte, msg proto.Message) error {
-	return proto.Unmarshal(msgBody, msg)
+	if err := proto.Unmarshal(msgBody, msg); err != nil {
+		return wrapRequiredNotSet(msg, err)
+	}
+	return nil
 }
 
-func encodeWithJSON(msg proto.Message) ([]byte, error) {
+func encodeWithJSON(msg proto.Message, opts Options) ([]byte, error) {
 	buf := bytes.NewBuffer(nil)
 	m := jsonpb.Marshaler{
-		EnumsAsInts:  true,
-		EmitDefaults: true,
+		EnumsAsInts:  opts.EnumsAsInts,
+		EmitDefaults: opts.EmitDefaults,
+		OrigName:     opts.OrigName,
+		Indent:       opts.Indent,
 	}
 	if err := m.Marshal(buf, msg); err != nil {
 		return nil, err
@@ -0,0 +1,202 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encoding
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestSelfDescribing(t *testing.T) {
+	msg := &wrappers.StringValue{Value: "Hello World"}
+
+	b, err := EncodeSelfDescribing(msg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	decoded, err := DecodeSelfDescribing(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if proto.Equal(msg, decoded) == false {
+		t.Fatalf("Not equal, %v\n", decoded)
+	}
+
+	// 修改类型名使其无法在注册表中找到
+	b[2] = 'x'
+	if _, err = DecodeSelfDescribing(b); err == nil {
+		t.Fatal("Decode unregistered type should fail")
+	}
+}
+
+func TestFieldError(t *testing.T) {
+	// UninterpretedOption.NamePart的name_part和is_extension均为必填字段
+	msg := &descriptorpb.UninterpretedOption{
+		Name: []*descriptorpb.UninterpretedOption_NamePart{
+			{NamePart: proto.String("host"), IsExtension: proto.Bool(false)},
+			{NamePart: proto.String("zone")},
+		},
+	}
+
+	_, err := Encode(WithPB, msg)
+	fieldErr, ok := err.(*FieldError)
+	if !ok {
+		t.Fatalf("Expect *FieldError, but got %v", err)
+	}
+	if fieldErr.MessageName != "google.protobuf.UninterpretedOption" || fieldErr.FieldPath != "name[1].is_extension" {
+		t.Fatalf("Unexpected FieldError: %#v", fieldErr)
+	}
+
+	// 非必填字段的错误原样返回
+	if err = Decode(WithPB, []byte{0xFF}, &wrappers.StringValue{}); err == nil {
+		t.Fatal("Decode bad msg should fail")
+	} else if _, ok = err.(*FieldError); ok {
+		t.Fatal("Bad wire format should not be a FieldError")
+	}
+}
+
+func TestStream(t *testing.T) {
+	msgs := []proto.Message{
+		&wrappers.StringValue{Value: "first"},
+		&wrappers.StringValue{Value: "second"},
+		&wrappers.StringValue{},
+		&wrappers.StringValue{Value: "third"},
+	}
+	newMsg := func() proto.Message { return &wrappers.StringValue{} }
+
+	for _, method := range []EncodeMethod{WithPB, WithJSON} {
+		buf := bytes.NewBuffer(nil)
+		if err := EncodeStream(method, buf, msgs...); err != nil {
+			t.Fatal(err.Error())
+		}
+		b := buf.Bytes()
+
+		var decoded []proto.Message
+		err := DecodeStream(method, bytes.NewReader(b), newMsg, func(msg proto.Message) error {
+			decoded = append(decoded, msg)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(decoded) != len(msgs) {
+			t.Fatalf("Expect %d msgs, but got %d", len(msgs), len(decoded))
+		}
+		for i := range msgs {
+			if proto.Equal(msgs[i], decoded[i]) == false {
+				t.Fatalf("(%s) Msg %d not equal, %v", method, i, decoded[i])
+			}
+		}
+
+		// 回调返回错误时停止读取
+		stop := errors.New("stop")
+		calls := 0
+		err = DecodeStream(method, bytes.NewReader(b), newMsg, func(msg proto.Message) error {
+			calls++
+			return stop
+		})
+		if err != stop || calls != 1 {
+			t.Fatalf("Expect stop after 1 msg, but got %v after %d", err, calls)
+		}
+
+		// 流在消息中间结束
+		ignore := func(proto.Message) error { return nil }
+		if err = DecodeStream(method, bytes.NewReader(b[:len(b)-1]), newMsg, ignore); err != io.ErrUnexpectedEOF {
+			t.Fatalf("Expect io.ErrUnexpectedEOF, but got %v", err)
+		}
+	}
+}
+
+func TestCompressed(t *testing.T) {
+	small := &wrappers.StringValue{Value: "tiny"}
+	b, err := EncodeCompressed(WithPB, small)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	raw, _ := Encode(WithPB, small)
+	if b[0] != markerRaw || !bytes.Equal(b[1:], raw) {
+		t.Fatalf("Small msg should stay uncompressed, %v", b)
+	}
+
+	large := &wrappers.StringValue{Value: strings.Repeat("large payload ", 1024)}
+	b, err = EncodeCompressed(WithPB, large)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	raw, _ = Encode(WithPB, large)
+	if b[0] != markerGzip || len(b) >= len(raw) {
+		t.Fatalf("Large msg should be compressed, %d >= %d", len(b), len(raw))
+	}
+
+	for _, msg := range []*wrappers.StringValue{small, large} {
+		b, _ = EncodeCompressed(WithPB, msg)
+		decoded := &wrappers.StringValue{}
+		if err = DecodeCompressed(WithPB, b, decoded); err != nil {
+			t.Fatal(err.Error())
+		}
+		if proto.Equal(msg, decoded) == false {
+			t.Fatalf("Not equal, %v\n", decoded)
+		}
+	}
+}
+
+func TestEncodeWith(t *testing.T) {
+	msg := &descriptorpb.FieldDescriptorProto{
+		Name:     proto.String("id"),
+		Type:     descriptorpb.FieldDescriptorProto_TYPE_INT32.Enum(),
+		JsonName: proto.String("id"),
+	}
+
+	// 默认选项：枚举为整数，输出零值字段
+	b, err := Encode(WithJSON, msg)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if s := string(b); !strings.Contains(s, `"type":5`) || !strings.Contains(s, `"label":null`) {
+		t.Fatalf("Unexpected default output %s", s)
+	}
+
+	b, err = EncodeWith(WithJSON, msg, Options{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if s := string(b); s != `{"name":"id","type":"TYPE_INT32","jsonName":"id"}` {
+		t.Fatalf("Unexpected output %s", s)
+	}
+
+	b, err = EncodeWith(WithJSON, msg, Options{OrigName: true, Indent: "  "})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if s := string(b); !strings.Contains(s, "\n  \"json_name\": \"id\"") {
+		t.Fatalf("Unexpected output %s", s)
+	}
+
+	decoded := &descriptorpb.FieldDescriptorProto{}
+	if err = Decode(WithJSON, b, decoded); err != nil {
+		t.Fatal(err.Error())
+	}
+	if proto.Equal(msg, decoded) == false {
+		t.Fatalf("Not equal, %v\n", decoded)
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encoding
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// FieldError 编解码时必填字段缺失的错误
+type FieldError struct {
+	// MessageName 顶层消息的全名
+	MessageName string
+
+	// FieldPath 缺失字段的路径，例如"spec.disks[0].name"，无法定位时为空
+	FieldPath string
+
+	// Err 原始错误
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	if len(e.FieldPath) <= 0 {
+		return fmt.Sprintf("%s: %v", e.MessageName, e.Err)
+	}
+	return fmt.Sprintf("%s: required field '%s' not set", e.MessageName, e.FieldPath)
+}
+
+// wrapRequiredNotSet 将必填字段缺失的错误包装为FieldError，其他错误原样返回
+func wrapRequiredNotSet(msg proto.Message, err error) error {
+	if e, ok := err.(interface{ RequiredNotSet() bool }); !ok || !e.RequiredNotSet() {
+		return err
+	}
+
+	m := proto.MessageReflect(msg)
+	return &FieldError{
+		MessageName: string(m.Descriptor().FullName()),
+		FieldPath:   findMissingRequired(m, ""),
+		Err:         err,
+	}
+}
+
+// findMissingRequired 深度优先查找第一个缺失的必填字段，返回其路径
+func findMissingRequired(m protoreflect.Message, prefix string) string {
+	fields := m.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		path := string(fd.Name())
+		if len(prefix) > 0 {
+			path = prefix + "." + path
+		}
+
+		if fd.Cardinality() == protoreflect.Required && !m.Has(fd) {
+			return path
+		}
+		if !m.Has(fd) {
+			continue
+		}
+
+		switch {
+		case fd.IsList() && fd.Message() != nil:
+			list := m.Get(fd).List()
+			for j := 0; j < list.Len(); j++ {
+				if p := findMissingRequired(list.Get(j).Message(), fmt.Sprintf("%s[%d]", path, j)); len(p) > 0 {
+					return p
+				}
+			}
+		case fd.IsMap() && fd.MapValue().Message() != nil:
+			var found string
+			m.Get(fd).Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+				found = findMissingRequired(v.Message(), fmt.Sprintf("%s[%v]", path, k.Interface()))
+				return len(found) <= 0
+			})
+			if len(found) > 0 {
+				return found
+			}
+		case fd.Message() != nil && !fd.IsList() && !fd.IsMap():
+			if p := findMissingRequired(m.Get(fd).Message(), path); len(p) > 0 {
+				return p
+			}
+		}
+	}
+	return ""
+}
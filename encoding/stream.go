@@ -0,0 +1,91 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package encoding
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// maxStreamMsgLen 流中单个消息的最大长度，避免数据损坏时按错误的长度分配内存
+const maxStreamMsgLen = 64 << 20
+
+// EncodeStream 以method依次编码msgs并写入w，每个消息之前写入4字节(大端)的长度
+// 读取方可据此逐个读取消息，见DecodeStream
+func EncodeStream(method EncodeMethod, w io.Writer, msgs ...proto.Message) error {
+	var prefix [4]byte
+	for i, msg := range msgs {
+		b, err := Encode(method, msg)
+		if err != nil {
+			return fmt.Errorf("Encode msg %d failed, %v", i, err)
+		}
+		if len(b) > maxStreamMsgLen {
+			return fmt.Errorf("Msg %d too long", i)
+		}
+		binary.BigEndian.PutUint32(prefix[:], uint32(len(b)))
+		if _, err = w.Write(prefix[:]); err != nil {
+			return err
+		}
+		if _, err = w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodeStream 从r中逐个读取EncodeStream写入的消息，每读取一个即调用fn，直至流结束
+// newMsg用于创建接收每个消息的实例，消息不会被缓存，内存占用与单个消息的大小相关。
+// fn返回错误时停止读取并返回该错误，流在消息中间结束时返回io.ErrUnexpectedEOF
+func DecodeStream(method EncodeMethod, r io.Reader, newMsg func() proto.Message, fn func(proto.Message) error) error {
+	var b []byte
+	var prefix [4]byte
+	for i := 0; ; i++ {
+		if _, err := io.ReadFull(r, prefix[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		n := binary.BigEndian.Uint32(prefix[:])
+		if n > maxStreamMsgLen {
+			return errors.New("Stream msg too long")
+		}
+		if uint32(cap(b)) < n {
+			b = make([]byte, n)
+		}
+		b = b[:n]
+		if _, err := io.ReadFull(r, b); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		// 各字段均为零值的消息以protobuf编码后长度为0，Decode会拒绝空消息体，直接使用零值
+		msg := newMsg()
+		if n > 0 {
+			if err := Decode(method, b, msg); err != nil {
+				return fmt.Errorf("Decode msg %d failed, %v", i, err)
+			}
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+}
@@ -1,13 +1,20 @@
 package encodingv2
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"reflect"
 
+	"github.com/Hurricanezwf/pkg/internal/gziputil"
 	"github.com/golang/protobuf/proto"
+	"github.com/vmihailenco/msgpack/v4"
 )
 
 // Encoding 编解码器的抽象
@@ -20,6 +27,15 @@ func DefaultEncoding() Encoding {
 	return NewProtoEncoding()
 }
 
+// writeAll 将b写入w，写入的字节数不足时返回io.ErrShortWrite
+func writeAll(w io.Writer, b []byte) error {
+	n, err := w.Write(b)
+	if err == nil && n < len(b) {
+		err = io.ErrShortWrite
+	}
+	return err
+}
+
 // GobEncoding 使用Gob的方式编解码
 type GobEncoding struct{}
 
@@ -46,12 +62,11 @@ func (e *ProtoEncoding) EncodeTo(w io.Writer, v interface{}) error {
 	if _, ok := v.(proto.Message); !ok {
 		return errors.New("v must be type of proto.Message")
 	}
-	if b, err := proto.Marshal(v.(proto.Message)); err != nil {
+	b, err := proto.Marshal(v.(proto.Message))
+	if err != nil {
 		return err
-	} else {
-		w.Write(b)
 	}
-	return nil
+	return writeAll(w, b)
 }
 
 func (e *ProtoEncoding) DecodeFrom(r io.Reader, v interface{}) error {
@@ -73,12 +88,11 @@ func NewJsonEncoding() *JsonEncoding {
 }
 
 func (e *JsonEncoding) EncodeTo(w io.Writer, v interface{}) error {
-	if b, err := json.Marshal(v); err != nil {
+	b, err := json.Marshal(v)
+	if err != nil {
 		return err
-	} else {
-		w.Write(b)
 	}
-	return nil
+	return writeAll(w, b)
 }
 
 func (e *JsonEncoding) DecodeFrom(r io.Reader, v interface{}) error {
@@ -88,3 +102,245 @@ func (e *JsonEncoding) DecodeFrom(r io.Reader, v interface{}) error {
 	}
 	return json.Unmarshal(b, v)
 }
+
+// MsgpackEncoding 使用msgpack的方式编解码，字段名取自msgpack标签
+type MsgpackEncoding struct{}
+
+func NewMsgpackEncoding() *MsgpackEncoding {
+	return &MsgpackEncoding{}
+}
+
+func (e *MsgpackEncoding) EncodeTo(w io.Writer, v interface{}) error {
+	b, err := msgpack.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeAll(w, b)
+}
+
+func (e *MsgpackEncoding) DecodeFrom(r io.Reader, v interface{}) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return msgpack.Unmarshal(b, v)
+}
+
+// XmlEncoding 使用xml的方式编解码
+// 根元素名默认取自XMLName字段或类型名，无法推断时使用Root：
+// 匿名结构体以Root作为根元素；切片的各元素被包裹在Root元素中，避免产生多个根元素。
+// 不支持map
+type XmlEncoding struct {
+	Root string
+}
+
+func NewXmlEncoding() *XmlEncoding {
+	return &XmlEncoding{Root: "root"}
+}
+
+func (e *XmlEncoding) EncodeTo(w io.Writer, v interface{}) error {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	start := xml.StartElement{Name: xml.Name{Local: e.Root}}
+	enc := xml.NewEncoder(w)
+
+	switch {
+	case !rv.IsValid():
+		return errors.New("v must not be nil")
+	case rv.Kind() == reflect.Map:
+		return errors.New("XmlEncoding does not support map")
+	case rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() != reflect.Uint8, rv.Kind() == reflect.Array:
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		if err := enc.EncodeToken(start.End()); err != nil {
+			return err
+		}
+		return enc.Flush()
+	case rv.Kind() == reflect.Struct && len(rv.Type().Name()) <= 0:
+		if _, ok := rv.Type().FieldByName("XMLName"); !ok {
+			return enc.EncodeElement(v, start)
+		}
+	}
+	return enc.Encode(v)
+}
+
+func (e *XmlEncoding) DecodeFrom(r io.Reader, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("v must be a non-nil pointer")
+	}
+	dec := xml.NewDecoder(r)
+	if elem := rv.Elem(); elem.Kind() != reflect.Slice || elem.Type().Elem().Kind() == reflect.Uint8 {
+		return dec.Decode(v)
+	}
+	return decodeXmlSlice(dec, rv.Elem())
+}
+
+// decodeXmlSlice 将根元素的各子元素依次解码并追加到切片s中
+func decodeXmlSlice(dec *xml.Decoder, s reflect.Value) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				depth++
+				continue
+			}
+			item := reflect.New(s.Type().Elem())
+			if err = dec.DecodeElement(item.Interface(), &t); err != nil {
+				return err
+			}
+			s.Set(reflect.Append(s, item.Elem()))
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// GzipEncoding 使用gzip压缩inner编码的结果
+// DecodeFrom只解压一个gzip流(不支持多个连续的gzip流)，r未实现io.ByteReader时可能越过流末尾读取，
+// 需要在同一个流上传输多个值时，应在外层使用FramedEncoding
+type GzipEncoding struct {
+	inner Encoding
+	level int
+}
+
+// NewGzipEncoding 返回以level(见compress/gzip)压缩inner编码结果的Encoding，
+// level无效时EncodeTo将返回错误
+func NewGzipEncoding(inner Encoding, level int) Encoding {
+	return &GzipEncoding{inner: inner, level: level}
+}
+
+func (e *GzipEncoding) EncodeTo(w io.Writer, v interface{}) error {
+	return gziputil.Encode(w, e.level, func(gw io.Writer) error {
+		return e.inner.EncodeTo(gw, v)
+	})
+}
+
+func (e *GzipEncoding) DecodeFrom(r io.Reader, v interface{}) error {
+	return gziputil.Decode(r, func(gr io.Reader) error {
+		return e.inner.DecodeFrom(gr, v)
+	})
+}
+
+// maxFrameLen FramedEncoding单个值的最大长度，避免数据损坏时按错误的长度分配内存
+const maxFrameLen = 64 << 20
+
+// FramedEncoding 为任意Encoding添加长度前缀，使同一个流上可以连续传输多个值
+// EncodeTo在每个值之前写入4字节(大端)的长度，DecodeFrom只读取一个值的字节，
+// 因此对同一个Reader重复调用DecodeFrom即可逐个读取，读到流末尾时返回io.EOF
+type FramedEncoding struct {
+	e Encoding
+}
+
+func NewFramedEncoding(e Encoding) *FramedEncoding {
+	return &FramedEncoding{e: e}
+}
+
+func (f *FramedEncoding) EncodeTo(w io.Writer, v interface{}) error {
+	buf := bytes.NewBuffer(make([]byte, 4, 64))
+	if err := f.e.EncodeTo(buf, v); err != nil {
+		return err
+	}
+	b := buf.Bytes()
+	if len(b)-4 > maxFrameLen {
+		return errors.New("Frame too long")
+	}
+	binary.BigEndian.PutUint32(b[:4], uint32(len(b)-4))
+	return writeAll(w, b)
+}
+
+func (f *FramedEncoding) DecodeFrom(r io.Reader, v interface{}) error {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(prefix[:])
+	if n > maxFrameLen {
+		return fmt.Errorf("Frame length %d too long", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return f.e.DecodeFrom(bytes.NewReader(b), v)
+}
+
+// JSONLinesEncoding 使用JSON Lines(每行一个JSON)的方式编解码
+// EncodeTo在每条记录之后追加换行符，DecodeFrom每次只读取一行，因此对同一个Reader
+// 重复调用DecodeFrom即可逐条遍历整个流，读到流末尾时返回io.EOF。
+// 为了不越过当前行读取，r未实现io.ByteReader时将逐字节读取，建议传入bufio.Reader
+type JSONLinesEncoding struct{}
+
+func NewJSONLinesEncoding() *JSONLinesEncoding {
+	return &JSONLinesEncoding{}
+}
+
+func (e *JSONLinesEncoding) EncodeTo(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	return writeAll(w, b)
+}
+
+func (e *JSONLinesEncoding) DecodeFrom(r io.Reader, v interface{}) error {
+	for {
+		line, err := readLine(r)
+		if len(bytes.TrimSpace(line)) > 0 {
+			return json.Unmarshal(line, v)
+		}
+		if err != nil {
+			return err
+		}
+		// 跳过空行
+	}
+}
+
+// readLine 读取一行(不含换行符)，不会读取换行符之后的数据
+func readLine(r io.Reader) ([]byte, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = &singleByteReader{r: r}
+	}
+
+	var line []byte
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return line, err
+		}
+		if c == '\n' {
+			return line, nil
+		}
+		line = append(line, c)
+	}
+}
+
+type singleByteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (s *singleByteReader) ReadByte() (byte, error) {
+	for {
+		n, err := s.r.Read(s.buf[:])
+		if n > 0 {
+			return s.buf[0], nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package encodingv2
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+type record struct {
+	Host string `json:"host"`
+	Code int    `json:"code"`
+}
+
+func TestJSONLinesEncoding(t *testing.T) {
+	e := NewJSONLinesEncoding()
+
+	buf := bytes.NewBuffer(nil)
+	records := []record{{"web1", 200}, {"web2", 502}, {"web3", 404}}
+	for _, r := range records {
+		if err := e.EncodeTo(buf, &r); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if bytes.Count(buf.Bytes(), []byte("\n")) != len(records) {
+		t.Fatalf("Each record should end with newline: %q", buf.String())
+	}
+
+	// 插入空行，且最后一行没有换行符
+	stream := append([]byte("\n"), buf.Bytes()...)
+	stream = append(stream, []byte(`{"host":"web4","code":200}`)...)
+	records = append(records, record{"web4", 200})
+
+	// bytes.Buffer实现了io.ByteReader，onlyReader则需要逐字节读取
+	for _, r := range []io.Reader{bytes.NewBuffer(stream), onlyReader{bytes.NewReader(stream)}} {
+		for i := 0; ; i++ {
+			var got record
+			err := e.DecodeFrom(r, &got)
+			if err == io.EOF {
+				if i != len(records) {
+					t.Fatalf("Decoded %d records, expect %d", i, len(records))
+				}
+				break
+			}
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			if got != records[i] {
+				t.Fatalf("Record %d: %#v != %#v", i, got, records[i])
+			}
+		}
+	}
+}
+
+type onlyReader struct {
+	r io.Reader
+}
+
+func (o onlyReader) Read(p []byte) (int, error) {
+	return o.r.Read(p)
+}
+
+func TestFramedEncoding(t *testing.T) {
+	// ProtoEncoding会读取整个流，需要分帧才能在同一个流上传输多个消息
+	e := NewFramedEncoding(NewProtoEncoding())
+
+	buf := bytes.NewBuffer(nil)
+	msgs := []string{"first", "", "third"}
+	for _, m := range msgs {
+		if err := e.EncodeTo(buf, &wrappers.StringValue{Value: m}); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	stream := buf.Bytes()
+
+	r := bytes.NewReader(stream)
+	for i := 0; ; i++ {
+		got := &wrappers.StringValue{}
+		err := e.DecodeFrom(r, got)
+		if err == io.EOF {
+			if i != len(msgs) {
+				t.Fatalf("Decoded %d msgs, expect %d", i, len(msgs))
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !proto.Equal(got, &wrappers.StringValue{Value: msgs[i]}) {
+			t.Fatalf("Msg %d: %q != %q", i, got.Value, msgs[i])
+		}
+	}
+
+	// 流在值中间结束
+	r = bytes.NewReader(stream[:len(stream)-1])
+	var err error
+	for err == nil {
+		err = e.DecodeFrom(r, &wrappers.StringValue{})
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Expect io.ErrUnexpectedEOF, but got %v", err)
+	}
+}
+
+func TestGzipEncoding(t *testing.T) {
+	msg := &wrappers.StringValue{Value: strings.Repeat("repetitive payload ", 256)}
+
+	raw := bytes.NewBuffer(nil)
+	if err := NewProtoEncoding().EncodeTo(raw, msg); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	e := NewGzipEncoding(NewProtoEncoding(), gzip.BestCompression)
+	buf := bytes.NewBuffer(nil)
+	if err := e.EncodeTo(buf, msg); err != nil {
+		t.Fatal(err.Error())
+	}
+	if buf.Len() >= raw.Len() {
+		t.Fatalf("Compressed size %d should be smaller than %d", buf.Len(), raw.Len())
+	}
+
+	got := &wrappers.StringValue{}
+	if err := e.DecodeFrom(buf, got); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !proto.Equal(got, msg) {
+		t.Fatal("Decoded msg mismatch")
+	}
+
+	if err := NewGzipEncoding(NewProtoEncoding(), 100).EncodeTo(ioutil.Discard, msg); err == nil {
+		t.Fatal("Invalid level should fail")
+	}
+}
+
+func TestMsgpackEncoding(t *testing.T) {
+	e := NewMsgpackEncoding()
+	in := record{"web1", 200}
+
+	buf := bytes.NewBuffer(nil)
+	if err := e.EncodeTo(buf, &in); err != nil {
+		t.Fatal(err.Error())
+	}
+	var out record
+	if err := e.DecodeFrom(buf, &out); err != nil {
+		t.Fatal(err.Error())
+	}
+	if out != in {
+		t.Fatalf("%#v != %#v", out, in)
+	}
+}
+
+func TestXmlEncoding(t *testing.T) {
+	e := NewXmlEncoding()
+
+	in := record{"web1", 200}
+	buf := bytes.NewBuffer(nil)
+	if err := e.EncodeTo(buf, &in); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.HasPrefix(buf.String(), "<record>") {
+		t.Fatalf("Root element should be inferred from type name: %s", buf.String())
+	}
+	var out record
+	if err := e.DecodeFrom(buf, &out); err != nil {
+		t.Fatal(err.Error())
+	}
+	if out != in {
+		t.Fatalf("%#v != %#v", out, in)
+	}
+
+	// 切片被包裹在根元素中
+	records := []record{{"web1", 200}, {"web2", 502}}
+	buf.Reset()
+	if err := e.EncodeTo(buf, records); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.HasPrefix(buf.String(), "<root><record>") {
+		t.Fatalf("Slice should be wrapped by root element: %s", buf.String())
+	}
+	var gotRecords []record
+	if err := e.DecodeFrom(buf, &gotRecords); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(gotRecords) != len(records) || gotRecords[0] != records[0] || gotRecords[1] != records[1] {
+		t.Fatalf("%#v != %#v", gotRecords, records)
+	}
+
+	// 匿名结构体使用Root作为根元素
+	anon := struct{ Name string }{"anonymous"}
+	buf.Reset()
+	if err := e.EncodeTo(buf, anon); err != nil {
+		t.Fatal(err.Error())
+	}
+	if buf.String() != "<root><Name>anonymous</Name></root>" {
+		t.Fatalf("Unexpected xml: %s", buf.String())
+	}
+
+	if err := e.EncodeTo(ioutil.Discard, map[string]int{"a": 1}); err == nil {
+		t.Fatal("Encode map should fail")
+	}
+}
+
+type upperEncoding struct {
+	JsonEncoding
+}
+
+func TestRegistry(t *testing.T) {
+	for _, name := range []string{"proto", "json", "gob"} {
+		if _, err := Get(name); err != nil {
+			t.Fatalf("Builtin encoding '%s' should be registered, %v", name, err)
+		}
+	}
+
+	Register("upper", func() Encoding { return &upperEncoding{} })
+	e, err := Get("upper")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := e.(*upperEncoding); !ok {
+		t.Fatalf("Unexpected encoding %T", e)
+	}
+
+	_, err = Get("yaml")
+	if err == nil {
+		t.Fatal("Get unknown encoding should fail")
+	}
+	if msg := err.Error(); !strings.Contains(msg, "'yaml'") || !strings.Contains(msg, "json, jsonlines") || !strings.Contains(msg, "upper") {
+		t.Fatalf("Unexpected error: %s", msg)
+	}
+}
+
+// faultyWriter 最多写入limit个字节，err不为空时直接返回错误
+type faultyWriter struct {
+	limit int
+	err   error
+}
+
+func (f *faultyWriter) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	if len(p) > f.limit {
+		return f.limit, nil
+	}
+	return len(p), nil
+}
+
+func TestEncodeWriteError(t *testing.T) {
+	writeErr := errors.New("connection reset")
+	encodings := []Encoding{NewProtoEncoding(), NewJsonEncoding(), NewMsgpackEncoding(), NewJSONLinesEncoding()}
+	msg := &wrappers.StringValue{Value: "hello"}
+
+	for _, e := range encodings {
+		if err := e.EncodeTo(&faultyWriter{err: writeErr}, msg); err != writeErr {
+			t.Fatalf("%T: expect write error, but got %v", e, err)
+		}
+		if err := e.EncodeTo(&faultyWriter{limit: 1}, msg); err != io.ErrShortWrite {
+			t.Fatalf("%T: expect io.ErrShortWrite, but got %v", e, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package encodingv2
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]func() Encoding)
+)
+
+func init() {
+	Register("proto", func() Encoding { return NewProtoEncoding() })
+	Register("json", func() Encoding { return NewJsonEncoding() })
+	Register("jsonlines", func() Encoding { return NewJSONLinesEncoding() })
+	Register("gob", func() Encoding { return NewGobEncoding() })
+	Register("msgpack", func() Encoding { return NewMsgpackEncoding() })
+	Register("xml", func() Encoding { return NewXmlEncoding() })
+}
+
+// Register 以name注册编解码器，便于根据配置中的名称选择，重复注册将覆盖之前的注册
+func Register(name string, factory func() Encoding) {
+	if factory == nil {
+		panic("encodingv2: Register factory is nil")
+	}
+	registryMu.Lock()
+	registry[name] = factory
+	registryMu.Unlock()
+}
+
+// Get 返回以name注册的编解码器，每次调用都会通过factory新建
+func Get(name string) (Encoding, error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown encoding '%s', registered: %s", name, strings.Join(Names(), ", "))
+	}
+	return factory(), nil
+}
+
+// Names 返回所有已注册的名称，按字典序排列
+func Names() []string {
+	registryMu.RLock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	registryMu.RUnlock()
+	sort.Strings(names)
+	return names
+}
@@ -2,4 +2,11 @@ module github.com/Hurricanezwf/pkg
 
 go 1.14
 
-require github.com/golang/protobuf v1.4.2
+require (
+	github.com/golang/protobuf v1.4.2
+	github.com/golang/snappy v0.0.4
+	github.com/klauspost/compress v1.11.13
+	github.com/vmihailenco/msgpack/v4 v4.3.12
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	google.golang.org/protobuf v1.23.0
+)
@@ -0,0 +1,176 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httplib
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ParseCurl 将cURL命令转换为RequestArgs，同时返回HTTP方法
+// 支持的选项: -X/--request, -H/--header, -d/--data/--data-raw/--data-binary, -u/--user，
+// 以及若干不影响请求内容的选项(如-s、-k、-L、--compressed)。
+// 携带-d且未指定-X时方法为POST，否则默认为GET
+func ParseCurl(cmd string) (*RequestArgs, string, error) {
+	tokens, err := splitCommand(cmd)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(tokens) <= 0 || tokens[0] != "curl" {
+		return nil, "", errors.New("Not a curl command")
+	}
+
+	var (
+		method string
+		data   []string
+		args   = &RequestArgs{Headers: make(map[string]string)}
+	)
+
+	for i := 1; i < len(tokens); i++ {
+		tok := tokens[i]
+
+		// 需要参数的选项
+		next := func() (string, error) {
+			if i+1 >= len(tokens) {
+				return "", fmt.Errorf("Missing value for option '%s'", tok)
+			}
+			i++
+			return tokens[i], nil
+		}
+
+		switch tok {
+		case "-X", "--request":
+			v, err := next()
+			if err != nil {
+				return nil, "", err
+			}
+			method = strings.ToUpper(v)
+		case "-H", "--header":
+			v, err := next()
+			if err != nil {
+				return nil, "", err
+			}
+			idx := strings.Index(v, ":")
+			if idx <= 0 {
+				return nil, "", fmt.Errorf("Bad header '%s'", v)
+			}
+			// 规范化键名，避免大小写不同的同名请求头同时存在
+			args.Headers[http.CanonicalHeaderKey(strings.TrimSpace(v[:idx]))] = strings.TrimSpace(v[idx+1:])
+		case "-d", "--data", "--data-raw", "--data-binary", "--data-ascii":
+			v, err := next()
+			if err != nil {
+				return nil, "", err
+			}
+			data = append(data, v)
+		case "-u", "--user":
+			v, err := next()
+			if err != nil {
+				return nil, "", err
+			}
+			args.Headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(v))
+		case "-s", "--silent", "-S", "--show-error", "-k", "--insecure", "-L", "--location",
+			"-v", "--verbose", "-i", "--include", "--compressed":
+			// 不影响请求内容
+		default:
+			if strings.HasPrefix(tok, "-") {
+				return nil, "", fmt.Errorf("Unsupported curl option '%s'", tok)
+			}
+			if len(args.URL) > 0 {
+				return nil, "", fmt.Errorf("Multiple URLs found: '%s' and '%s'", args.URL, tok)
+			}
+			args.URL = tok
+		}
+	}
+
+	if len(args.URL) <= 0 {
+		return nil, "", errors.New("Missing URL in curl command")
+	}
+	if len(data) > 0 {
+		args.Body = []byte(strings.Join(data, "&"))
+		if _, exist := args.Headers["Content-Type"]; !exist {
+			args.Headers["Content-Type"] = "application/x-www-form-urlencoded"
+		}
+	}
+	if len(method) <= 0 {
+		method = http.MethodGet
+		if len(data) > 0 {
+			method = http.MethodPost
+		}
+	}
+	return args, method, nil
+}
+
+// splitCommand 按照shell的规则拆分命令行，支持单引号、双引号、反斜杠转义与续行
+func splitCommand(cmd string) ([]string, error) {
+	var (
+		tokens  []string
+		cur     strings.Builder
+		inToken bool
+		quote   rune
+		escaped bool
+	)
+
+	for _, r := range cmd {
+		switch {
+		case escaped:
+			// 反斜杠续行
+			if r != '\n' {
+				cur.WriteRune(r)
+				inToken = true
+			}
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				cur.WriteRune(r)
+			}
+		case r == '\\':
+			escaped = true
+		case r == '\'' || r == '"':
+			quote = r
+			inToken = true
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inToken {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+				inToken = false
+			}
+		default:
+			cur.WriteRune(r)
+			inToken = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("Unterminated quote in command")
+	}
+	if inToken {
+		tokens = append(tokens, cur.String())
+	}
+	return tokens, nil
+}
@@ -15,13 +15,27 @@
 package httplib
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/astaxie/beego/httplib"
@@ -30,6 +44,9 @@ import (
 // FilterFunc 过滤器函数
 type FilterFunc func(args *RequestArgs) error
 
+// ResponseFilterFunc 响应过滤器，收到响应后、解析响应体之前调用
+type ResponseFilterFunc func(args *RequestArgs, rp *http.Response) error
+
 // RequestArgs 通用请求参数封装
 type RequestArgs struct {
 	// URL 请求地址 (必填)
@@ -39,16 +56,45 @@ type RequestArgs struct {
 	// nil表示不设置请求头
 	Headers map[string]string
 
+	// BasicAuth HTTP基本认证 (可选)
+	BasicAuth *BasicAuth
+
+	// BearerToken Bearer认证令牌 (可选)
+	// 与BasicAuth同时设置时以BearerToken为准
+	BearerToken string
+
 	// Params HTTP请求参数，键值对 (可选)
 	Params map[string]string
 
+	// ParamsMulti HTTP请求参数，同一个键可对应多个值，如?id=1&id=2 (可选)
+	// 可与Params同时使用，相同的键将追加而非覆盖
+	ParamsMulti map[string][]string
+
 	// Body HTTP请求体设置，必须是struct或[]byte类型 (可选)
 	// nil表示无请求体
 	Body interface{}
 
+	// FormBody 以application/x-www-form-urlencoded格式发送的表单 (可选)
+	// 会覆盖Headers中的Content-Type，不能与Body或Files同时使用
+	FormBody map[string]string
+
+	// Files 上传文件，表单字段名到文件路径的映射 (可选)
+	// 非空时以multipart/form-data格式发送，文件内容流式写入而不会整体读入内存，不能与Body同时使用
+	Files map[string]string
+
+	// FormFields multipart/form-data中的普通表单字段 (可选)
+	// 仅在Files非空时生效
+	FormFields map[string]string
+
 	// Filters 请求过滤器，会在请求发出前依次调用
 	Filters []FilterFunc
 
+	// ResponseFilters 响应过滤器 (可选)
+	// 每次收到响应(包括重试)后按顺序调用，此时StatusCode和ResponseHeaders已填充，
+	// 而重定向处理、状态码校验及响应体解析尚未进行。任一过滤器返回错误时，
+	// 后续过滤器不再执行并直接返回该错误，不会重试。过滤器不应读取rp.Body
+	ResponseFilters []ResponseFilterFunc
+
 	// JSONResult 接收JSON格式的响应内容, 必须是strcut类型 (可选)
 	// 如果该字段非空，将自动解析至JSONResult
 	JSONResult interface{}
@@ -56,6 +102,117 @@ type RequestArgs struct {
 	// BytesResult 接收字节流响应内容 (可选)
 	// 如果该字段非空，响应体内容将被写入BytesResult
 	BytesResult *bytes.Buffer
+
+	// WriteTo 接收响应体的Writer (可选)
+	// 非空时响应体将通过io.Copy直接写入，不经过内存缓冲，适用于下载大文件。
+	// 状态码校验在写入之前进行，失败时不会写入任何内容
+	WriteTo io.Writer
+
+	// Ctx 请求的上下文 (可选)
+	// 取消或超时时请求立即返回ctx.Err()，即context.Canceled或context.DeadlineExceeded
+	Ctx context.Context
+
+	// ConnectTimeout、RWTimeout、Retry 覆盖客户端的同名配置 (可选)
+	// nil表示使用客户端的配置
+	ConnectTimeout *time.Duration
+	RWTimeout      *time.Duration
+	Retry          *int
+
+	// AcceptStatus 判断响应状态码是否视为成功 (可选)
+	// nil表示使用客户端的SuccessCodes
+	AcceptStatus func(code int) bool
+
+	// Location 未跟随重定向时，3xx响应中的Location头 (由请求结果填充)
+	Location string
+
+	// StatusCode 响应状态码 (由请求结果填充)
+	StatusCode int
+
+	// ResponseHeaders 响应头 (由请求结果填充)
+	ResponseHeaders http.Header
+
+	// Latency 最后一次请求从发出到读完响应体的耗时 (由请求结果填充)
+	Latency time.Duration
+}
+
+// BasicAuth HTTP基本认证的用户名和密码
+type BasicAuth struct {
+	User string
+	Pass string
+}
+
+// Clone 深拷贝请求参数，便于以同一份参数为模板在多个goroutine中并发请求
+// Headers、Params、ParamsMulti、FormBody、Files、FormFields、Filters及ResponseFilters会被复制；[]byte类型的Body被复制，
+// 其它类型的Body被序列化为JSON快照(与发送时的处理一致)。
+// JSONResult、BytesResult、WriteTo属于每次调用的输出，不会被复制，需在克隆后自行设置；
+// 由请求结果填充的字段同样被置空。
+func (args *RequestArgs) Clone() *RequestArgs {
+	c := *args
+	c.Headers = copyStringMap(args.Headers)
+	if args.BasicAuth != nil {
+		auth := *args.BasicAuth
+		c.BasicAuth = &auth
+	}
+	c.Params = copyStringMap(args.Params)
+	if args.ParamsMulti != nil {
+		c.ParamsMulti = make(map[string][]string, len(args.ParamsMulti))
+		for k, v := range args.ParamsMulti {
+			c.ParamsMulti[k] = append([]string(nil), v...)
+		}
+	}
+	c.FormBody = copyStringMap(args.FormBody)
+	c.Files = copyStringMap(args.Files)
+	c.FormFields = copyStringMap(args.FormFields)
+	if args.Filters != nil {
+		c.Filters = append([]FilterFunc(nil), args.Filters...)
+	}
+	if args.ResponseFilters != nil {
+		c.ResponseFilters = append([]ResponseFilterFunc(nil), args.ResponseFilters...)
+	}
+
+	switch body := args.Body.(type) {
+	case nil:
+	case []byte:
+		c.Body = append([]byte(nil), body...)
+	default:
+		// 序列化失败时保留原值，错误将在发送时返回
+		if b, err := json.Marshal(body); err == nil {
+			c.Body = b
+		}
+	}
+
+	if args.ConnectTimeout != nil {
+		v := *args.ConnectTimeout
+		c.ConnectTimeout = &v
+	}
+	if args.RWTimeout != nil {
+		v := *args.RWTimeout
+		c.RWTimeout = &v
+	}
+	if args.Retry != nil {
+		v := *args.Retry
+		c.Retry = &v
+	}
+
+	c.JSONResult = nil
+	c.BytesResult = nil
+	c.WriteTo = nil
+	c.Location = ""
+	c.StatusCode = 0
+	c.ResponseHeaders = nil
+	c.Latency = 0
+	return &c
+}
+
+func copyStringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
 }
 
 type HTTPClient struct {
@@ -72,10 +229,67 @@ type HTTPClient struct {
 	RWTimeout time.Duration
 
 	// Retry 请求重试次数
+	// 仅在连接失败或服务端返回5xx时重试，默认只重试幂等方法，POST需开启RetryPost
 	Retry int
 
+	// SuccessCodes 视为成功的响应状态码 (可选)
+	// nil表示2xx均为成功，需要更严格的校验时可设置为[]int{200}
+	SuccessCodes []int
+
+	// RetryBackoff 第attempt次(从0开始)重试前的等待时间
+	// nil表示使用DefaultRetryBackoff，即带随机抖动的指数退避
+	RetryBackoff func(attempt int) time.Duration
+
+	// RetryPost 是否允许重试非幂等的POST请求
+	// 开启前请确认服务端能够处理重复请求
+	RetryPost bool
+
+	// OnRetry 每次重试前调用，err为触发本次重试的错误，attempt从0开始 (可选)
+	// 可用于统计重试次数，重试率过高通常意味着上游服务异常
+	OnRetry func(attempt int, method, url string, err error)
+
+	// MetricsHook 每次请求结束后调用，d为请求从发出到读完响应体的耗时 (可选)
+	// 请求未收到响应时status为0，可用于上报监控指标
+	MetricsHook func(method, url string, status int, d time.Duration)
+
+	// DisableRedirects 是否禁止自动跟随重定向，默认跟随
+	// 为true时3xx响应将视为成功直接返回，可通过RequestArgs.Location获取跳转地址
+	DisableRedirects bool
+
+	// MaxRedirects 跟随重定向的最大次数，<=0表示最多跟随10次
+	// 超过时返回ErrTooManyRedirects。注意net/http默认最多发出10次请求，即只跟随9次
+	MaxRedirects int
+
+	// DefaultHeaders 每个请求默认携带的请求头 (可选)
+	// 与RequestArgs.Headers合并，键名不区分大小写，冲突时以RequestArgs.Headers为准
+	DefaultHeaders map[string]string
+
 	// Debug 调试信息写入
 	Debug logWriter
+
+	// DisableDecompression 是否禁用响应体自动解压
+	// 默认根据响应头Content-Encoding自动解压gzip和deflate，禁用后返回原始字节。
+	// 禁用时若请求未设置Accept-Encoding，将自动携带"gzip, deflate"
+	DisableDecompression bool
+
+	// Jar 保存并携带Cookie，用于需要维持会话的接口 (可选)
+	// 非空时响应设置的Cookie会在后续请求中自动带上，需在发出第一个请求之前设置
+	Jar http.CookieJar
+
+	// MaxConcurrent 同时进行中的请求数上限，<=0表示不限制
+	// 达到上限时新的请求将阻塞等待，需在发出第一个请求之前设置
+	MaxConcurrent int
+
+	// 自定义域名解析，通过SetStaticHosts或SetDNSCacheTTL启用
+	mutex    sync.Mutex
+	resolver *resolver
+
+	// 按超时时间缓存的Transport，覆盖了超时时间的请求也能复用连接
+	transports map[transportKey]*http.Transport
+
+	// 并发控制
+	semaphore chan struct{}
+	inFlight  int32
 }
 
 func DefaultHTTPClient() *HTTPClient {
@@ -89,30 +303,60 @@ func DefaultHTTPClient() *HTTPClient {
 	}
 }
 
+// NewHTTPClientWithJar 返回带有CookieJar的默认客户端
+func NewHTTPClientWithJar() *HTTPClient {
+	c := DefaultHTTPClient()
+	c.Jar, _ = cookiejar.New(nil) // 不指定PublicSuffixList时不会返回错误
+	return c
+}
+
 func (c *HTTPClient) Head(args *RequestArgs) error {
-	return c.send(httplib.Head(args.URL), args)
+	return c.send(http.MethodHead, args)
 }
 
 func (c *HTTPClient) Get(args *RequestArgs) error {
-	return c.send(httplib.Get(args.URL), args)
+	return c.send(http.MethodGet, args)
 }
 
 func (c *HTTPClient) Post(args *RequestArgs) error {
-	return c.send(httplib.Post(args.URL), args)
+	return c.send(http.MethodPost, args)
 }
 
 func (c *HTTPClient) Put(args *RequestArgs) error {
-	return c.send(httplib.Put(args.URL), args)
+	return c.send(http.MethodPut, args)
 }
 
 func (c *HTTPClient) Delete(args *RequestArgs) error {
-	return c.send(httplib.Delete(args.URL), args)
+	return c.send(http.MethodDelete, args)
+}
+
+func (c *HTTPClient) Patch(args *RequestArgs) error {
+	return c.send(http.MethodPatch, args)
+}
+
+// Do 按照HTTP方法发送请求，可配合ParseCurl使用
+func (c *HTTPClient) Do(method string, args *RequestArgs) error {
+	switch strings.ToUpper(method) {
+	case http.MethodHead:
+		return c.Head(args)
+	case http.MethodGet:
+		return c.Get(args)
+	case http.MethodPost:
+		return c.Post(args)
+	case http.MethodPut:
+		return c.Put(args)
+	case http.MethodDelete:
+		return c.Delete(args)
+	case http.MethodPatch:
+		return c.Patch(args)
+	}
+	return fmt.Errorf("Unsupported http method '%s'", method)
 }
 
 // complete 补全请求参数到BeegoHTTPRequest中
 func (c *HTTPClient) complete(req *httplib.BeegoHTTPRequest, args *RequestArgs) error {
 	// 设置请求头
-	for headerK, headerV := range args.Headers {
+	for headerK, headerV := range c.mergeHeaders(args.Headers) {
 		if strings.ToLower(headerK) != "host" {
 			req.Header(headerK, headerV)
 		} else {
@@ -120,10 +364,28 @@ func (c *HTTPClient) complete(req *httplib.BeegoHTTPRequest, args *RequestArgs)
 		}
 	}
 
+	// 设置认证信息，会覆盖Headers中的Authorization
+	if len(args.BearerToken) > 0 {
+		req.Header("Authorization", "Bearer "+args.BearerToken)
+	} else if args.BasicAuth != nil {
+		cred := args.BasicAuth.User + ":" + args.BasicAuth.Pass
+		req.Header("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(cred)))
+	}
+
+	// 禁用解压时显式声明Accept-Encoding，否则net/http会自动解压gzip响应
+	if c.DisableDecompression && req.GetRequest().Header.Get("Accept-Encoding") == "" {
+		req.Header("Accept-Encoding", "gzip, deflate")
+	}
+
 	// 设置请求参数
 	for reqK, reqV := range args.Params {
 		req.Param(reqK, reqV)
 	}
+	for reqK, reqVs := range args.ParamsMulti {
+		for _, reqV := range reqVs {
+			req.Param(reqK, reqV)
+		}
+	}
 
 	// 设置是否启用HTTPS
 	if c.EnableHTTPS {
@@ -131,14 +393,69 @@ func (c *HTTPClient) complete(req *httplib.BeegoHTTPRequest, args *RequestArgs)
 	}
 
 	// 设置超时时间
-	req.SetTimeout(c.ConnectTimeout, c.RWTimeout)
+	connectTimeout, rwTimeout := c.ConnectTimeout, c.RWTimeout
+	if args.ConnectTimeout != nil {
+		connectTimeout = *args.ConnectTimeout
+	}
+	if args.RWTimeout != nil {
+		rwTimeout = *args.RWTimeout
+	}
+	req.SetTimeout(connectTimeout, rwTimeout)
 
-	// 设置重试次数
-	req.Retries(c.Retry)
+	// 设置重定向策略
+	if f := c.checkRedirect(); f != nil {
+		req.SetCheckRedirect(f)
+	}
+
+	// 设置自定义Transport(自定义域名解析、CookieJar)，与beego默认的Transport一样限制连接及读写超时
+	var rt http.RoundTripper
+	if t := c.getTransport(connectTimeout, rwTimeout); t != nil {
+		rt = t
+	}
+	if rt != nil && c.Jar != nil {
+		rt = &jarTransport{base: rt, jar: c.Jar}
+	}
+	if rt != nil {
+		req.SetTransport(rt)
+	}
+
+	// 重试由send负责，不使用beego的立即重试
+	req.Retries(0)
 
 	// 设置Debug
 	req.Debug((c.Debug != nil))
 
+	// 设置表单
+	if len(args.FormBody) > 0 {
+		if args.Body != nil || len(args.Files) > 0 {
+			return errors.New("FormBody can not be set with Body or Files")
+		}
+		form := make(url.Values, len(args.FormBody))
+		for k, v := range args.FormBody {
+			form.Set(k, v)
+		}
+		req.Header("Content-Type", "application/x-www-form-urlencoded")
+		req.Body(form.Encode())
+		return nil
+	}
+
+	// 设置上传文件
+	if len(args.Files) > 0 {
+		if args.Body != nil {
+			return errors.New("Body and Files can not be set at the same time")
+		}
+		for field, path := range args.Files {
+			if _, err := os.Stat(path); err != nil {
+				return fmt.Errorf("Stat upload file failed, %v", err)
+			}
+			req.PostFile(field, path)
+		}
+		for k, v := range args.FormFields {
+			req.Param(k, v)
+		}
+		return nil
+	}
+
 	// 设置请求体
 	if args.Body == nil {
 		return nil
@@ -156,6 +473,205 @@ func (c *HTTPClient) complete(req *httplib.BeegoHTTPRequest, args *RequestArgs)
 	return nil
 }
 
+// decodeBody 按照Content-Encoding解压响应体
+// 请求未携带Accept-Encoding时net/http会自动处理gzip并移除该响应头，此处处理其余情况
+func decodeBody(rp *http.Response) (io.Reader, error) {
+	var r io.Reader
+	var err error
+	br := bufio.NewReader(rp.Body)
+	switch strings.ToLower(strings.TrimSpace(rp.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(br)
+	case "deflate":
+		// 标准的deflate为zlib格式，但也有服务端直接返回原始deflate数据
+		header, peekErr := br.Peek(2)
+		if len(header) == 0 && peekErr == io.EOF {
+			// 空响应体
+			return br, nil
+		}
+		if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			r, err = zlib.NewReader(br)
+		} else {
+			r = flate.NewReader(br)
+		}
+	default:
+		return rp.Body, nil
+	}
+	if err == io.EOF {
+		// 空响应体
+		return br, nil
+	}
+	return r, err
+}
+
+// InFlight 返回当前进行中的请求数
+func (c *HTTPClient) InFlight() int {
+	return int(atomic.LoadInt32(&c.inFlight))
+}
+
+// acquire 获取一个并发名额，返回释放函数
+// 等待名额期间ctx结束将返回ctx.Err()
+func (c *HTTPClient) acquire(ctx context.Context) (func(), error) {
+	sem := c.getSemaphore()
+	if sem != nil {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	atomic.AddInt32(&c.inFlight, 1)
+
+	return func() {
+		atomic.AddInt32(&c.inFlight, -1)
+		if sem != nil {
+			<-sem
+		}
+	}, nil
+}
+
+func (c *HTTPClient) getSemaphore() chan struct{} {
+	if c.MaxConcurrent <= 0 {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.semaphore == nil {
+		c.semaphore = make(chan struct{}, c.MaxConcurrent)
+	}
+	return c.semaphore
+}
+
+// checkRedirect 根据DisableRedirects和MaxRedirects生成重定向策略
+func (c *HTTPClient) checkRedirect() func(req *http.Request, via []*http.Request) error {
+	if c.DisableRedirects {
+		return func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	max := c.MaxRedirects
+	if max <= 0 {
+		max = defaultMaxRedirects
+	}
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > max {
+			return fmt.Errorf("%w, stopped after %d redirects", ErrTooManyRedirects, max)
+		}
+		return nil
+	}
+}
+
+// defaultMaxRedirects 未设置MaxRedirects时最多跟随的次数，共发出11次请求
+// net/http在len(via) >= 10时停止，比这里少跟随一次
+const defaultMaxRedirects = 10
+
+// ErrTooManyRedirects 重定向次数超过MaxRedirects，该错误不会被重试
+var ErrTooManyRedirects = errors.New("too many redirects")
+
+// SetStaticHosts 设置静态的域名到IP的映射，命中时不再进行DNS解析
+// 注意：固定IP会绕过DNS的故障切换，上游迁移后需要及时更新；未启用HTTPS时也无法
+// 发现IP被劫持的情况。启用HTTPS时证书仍按原域名校验
+func (c *HTTPClient) SetStaticHosts(hosts map[string]string) {
+	c.enableResolver().setStatic(hosts)
+}
+
+// SetDNSCacheTTL 设置DNS解析结果的缓存时长，<=0表示不缓存
+func (c *HTTPClient) SetDNSCacheTTL(ttl time.Duration) {
+	c.enableResolver().setTTL(ttl)
+}
+
+func (c *HTTPClient) enableResolver() *resolver {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.resolver == nil {
+		c.resolver = newResolver()
+	}
+	return c.resolver
+}
+
+// transportKey Transport缓存的键，不同的超时时间需要不同的Transport
+type transportKey struct {
+	connectTimeout time.Duration
+	rwTimeout      time.Duration
+}
+
+// getTransport 启用自定义域名解析或CookieJar时返回对应超时时间共享的Transport，否则返回nil
+// 每组超时时间只创建一个Transport，避免每个请求新建Transport而泄漏空闲连接
+func (c *HTTPClient) getTransport(connectTimeout, rwTimeout time.Duration) *http.Transport {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.resolver == nil && c.Jar == nil {
+		return nil
+	}
+	key := transportKey{connectTimeout: connectTimeout, rwTimeout: rwTimeout}
+	t, ok := c.transports[key]
+	if !ok {
+		if c.transports == nil {
+			c.transports = make(map[transportKey]*http.Transport)
+		}
+		t = c.newTransport(c.resolver, connectTimeout, rwTimeout)
+		c.transports[key] = t
+	}
+	return t
+}
+
+// newTransport 创建使用自定义域名解析的Transport，r为nil时使用系统DNS
+// 连接的读写超时为rwTimeout，见resolver.dialer
+// 与beego默认的Transport一致不使用代理，否则会连接代理而使SetStaticHosts失效
+func (c *HTTPClient) newTransport(r *resolver, connectTimeout, rwTimeout time.Duration) *http.Transport {
+	if r == nil {
+		r = newResolver()
+	}
+	return &http.Transport{
+		DialContext:     r.dialer(connectTimeout, rwTimeout),
+		TLSClientConfig: c.TLSConfig,
+	}
+}
+
+// jarTransport 在每次往返(包括重定向)时从jar读取Cookie并保存响应设置的Cookie
+// beego的请求不支持单独指定CookieJar，因此在Transport层实现
+type jarTransport struct {
+	base http.RoundTripper
+	jar  http.CookieJar
+}
+
+func (t *jarTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if cookies := t.jar.Cookies(req.URL); len(cookies) > 0 {
+		req = req.Clone(req.Context())
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+	}
+	rp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if cookies := rp.Cookies(); len(cookies) > 0 {
+		t.jar.SetCookies(req.URL, cookies)
+	}
+	return rp, nil
+}
+
+// mergeHeaders 合并默认请求头与请求自身的请求头，后者优先
+func (c *HTTPClient) mergeHeaders(headers map[string]string) map[string]string {
+	if len(c.DefaultHeaders) <= 0 {
+		return headers
+	}
+
+	merged := make(map[string]string, len(c.DefaultHeaders)+len(headers))
+	for k, v := range c.DefaultHeaders {
+		merged[http.CanonicalHeaderKey(k)] = v
+	}
+	for k, v := range headers {
+		merged[http.CanonicalHeaderKey(k)] = v
+	}
+	return merged
+}
+
 // filters 执行所有过滤器
 func (c *HTTPClient) filters(args *RequestArgs) (err error) {
 	for idx, f := range args.Filters {
@@ -166,48 +682,194 @@ func (c *HTTPClient) filters(args *RequestArgs) (err error) {
 	return nil
 }
 
-// send 发送请求
-func (c *HTTPClient) send(req *httplib.BeegoHTTPRequest, args *RequestArgs) error {
-	var err error
+// send 发送请求，失败时按照RetryBackoff退避后重试
+func (c *HTTPClient) send(method string, args *RequestArgs) error {
+	// 执行过滤器
+	if err := c.filters(args); err != nil {
+		return err
+	}
+
+	ctx := args.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	retry := c.Retry
+	if args.Retry != nil {
+		retry = *args.Retry
+	}
+	if !c.retryable(method) {
+		retry = 0
+	}
+
+	for attempt := 0; ; attempt++ {
+		temporary, err := c.sendOnce(ctx, httplib.NewBeegoRequest(args.URL, method), args)
+		if err == nil || !temporary || attempt >= retry {
+			return err
+		}
+		if c.Debug != nil {
+			c.Debug.Println("(%d) %s %s failed, %v", attempt, method, args.URL, err)
+		}
+		if c.OnRetry != nil {
+			c.OnRetry(attempt, method, args.URL, err)
+		}
+
+		t := time.NewTimer(c.backoff(attempt))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// retryable 判断该方法的请求是否允许重试
+func (c *HTTPClient) retryable(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return true
+	case http.MethodPost:
+		return c.RetryPost
+	}
+	return false
+}
+
+func (c *HTTPClient) backoff(attempt int) time.Duration {
+	if c.RetryBackoff != nil {
+		return c.RetryBackoff(attempt)
+	}
+	return DefaultRetryBackoff(attempt)
+}
+
+// DefaultRetryBackoff 带随机抖动的指数退避
+// 第attempt次重试的基础等待时间为100ms*2^attempt(最长10s)，实际等待时间在基础时间的[1/2, 1)之间随机
+func DefaultRetryBackoff(attempt int) time.Duration {
+	d := maxRetryBackoff
+	if attempt < 16 {
+		if d = baseRetryBackoff << uint(attempt); d > maxRetryBackoff {
+			d = maxRetryBackoff
+		}
+	}
+
+	jitterMutex.Lock()
+	jitter := time.Duration(jitterRand.Int63n(int64(d / 2)))
+	jitterMutex.Unlock()
+	return d/2 + jitter
+}
+
+const (
+	baseRetryBackoff = 100 * time.Millisecond
+	maxRetryBackoff  = 10 * time.Second
+)
+
+var (
+	jitterMutex sync.Mutex
+	jitterRand  = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// sendOnce 发送一次请求，temporary表示失败是否可以重试
+func (c *HTTPClient) sendOnce(ctx context.Context, req *httplib.BeegoHTTPRequest, args *RequestArgs) (temporary bool, err error) {
 	var rp *http.Response
 
 	// 设置必要信息
 	if err = c.complete(req, args); err != nil {
-		return err
+		return false, err
 	}
 
-	// 执行过滤器
-	if err = c.filters(args); err != nil {
-		return err
+	// 设置上下文
+	if args.Ctx != nil {
+		r := req.GetRequest()
+		*r = *r.WithContext(ctx)
 	}
 
-	// 发送请求
+	// 并发控制，响应处理完毕后释放
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	// 发送请求，记录从发出到响应处理完毕的耗时
+	start := time.Now()
+	defer func() {
+		status := 0
+		if rp != nil {
+			status = rp.StatusCode
+		}
+		args.Latency = time.Since(start)
+		if c.MetricsHook != nil {
+			c.MetricsHook(req.GetRequest().Method, args.URL, status, args.Latency)
+		}
+	}()
 	if rp, err = req.Response(); err != nil {
-		return err
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		return !errors.Is(err, ErrTooManyRedirects), err
 	}
 	defer rp.Body.Close()
 
+	args.StatusCode = rp.StatusCode
+	args.ResponseHeaders = rp.Header
+
 	if c.Debug != nil {
 		c.Debug.Println("\n%s", string(req.DumpRequest()))
 	}
 
+	// 执行响应过滤器
+	for idx, f := range args.ResponseFilters {
+		if err = f(args, rp); err != nil {
+			return false, fmt.Errorf("Call response filter at index %d failed, %v", idx, err)
+		}
+	}
+
+	// 未跟随的重定向视为成功
+	if c.DisableRedirects && rp.StatusCode >= 300 && rp.StatusCode < 400 {
+		args.Location = rp.Header.Get("Location")
+		return false, nil
+	}
+
+	// 解压响应体
+	body := io.Reader(rp.Body)
+	if !c.DisableDecompression {
+		if body, err = decodeBody(rp); err != nil {
+			return false, fmt.Errorf("Decompress http body failed, %v", err)
+		}
+	}
+
+	// 流式写入响应体
+	if args.WriteTo != nil && c.acceptStatus(args, rp.StatusCode) {
+		if _, err = io.Copy(args.WriteTo, body); err != nil {
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+			return false, fmt.Errorf("Write http body failed, %v", err)
+		}
+		return false, nil
+	}
+
 	// 读取响应体
 	var n int64
 	var buf = bytes.NewBuffer(nil)
-	if n, err = buf.ReadFrom(rp.Body); err != nil {
-		return fmt.Errorf("Read http body failed, %v", err)
+	if n, err = buf.ReadFrom(body); err != nil {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		return false, fmt.Errorf("Read http body failed, %v", err)
 	}
 
-	// 解析结果
-	if rp.StatusCode != 200 {
-		return fmt.Errorf("StatusCode(%d) != 200, %s", rp.StatusCode, buf.String())
+	// 解析结果，5xx可以重试
+	temporary = rp.StatusCode >= 500
+	if !c.acceptStatus(args, rp.StatusCode) {
+		return temporary, fmt.Errorf("StatusCode(%d) not accepted, %s", rp.StatusCode, buf.String())
 	}
-	if args.JSONResult != nil {
+	if args.JSONResult != nil && rp.StatusCode != http.StatusNoContent {
 		if c.Debug != nil {
 			c.Debug.Println("[%d Bytes] %s: %s\n", buf.Len(), reflect.TypeOf(args.JSONResult), buf.String())
 		}
 		if err = json.Unmarshal(buf.Next(int(n)), args.JSONResult); err != nil {
-			return fmt.Errorf("Bad response format, %v", err)
+			return false, fmt.Errorf("Bad response format, %v", err)
 		}
 	}
 	if args.BytesResult != nil {
@@ -216,5 +878,22 @@ func (c *HTTPClient) send(req *httplib.BeegoHTTPRequest, args *RequestArgs) erro
 		}
 		buf.WriteTo(args.BytesResult)
 	}
-	return nil
+	return false, nil
+}
+
+// acceptStatus 判断状态码是否视为成功
+// 优先使用RequestArgs.AcceptStatus，其次是SuccessCodes，默认2xx均为成功
+func (c *HTTPClient) acceptStatus(args *RequestArgs, code int) bool {
+	if args.AcceptStatus != nil {
+		return args.AcceptStatus(code)
+	}
+	if c.SuccessCodes == nil {
+		return code >= 200 && code < 300
+	}
+	for _, v := range c.SuccessCodes {
+		if v == code {
+			return true
+		}
+	}
+	return false
 }
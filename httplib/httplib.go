@@ -42,6 +42,11 @@ func Delete(args *RequestArgs) error {
 	return httpClient.Delete(args)
 }
 
+// Patch 发送Patch请求
+func Patch(args *RequestArgs) error {
+	return httpClient.Patch(args)
+}
+
 // ResetDefaultClient 替换默认的HTTP客户端
 func ResetDefaultClient(c *HTTPClient) {
 	httpClient = c
@@ -16,11 +16,25 @@ package httplib
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type logwriter struct {
@@ -80,3 +94,961 @@ func TestFilter(t *testing.T) {
 
 	t.Logf("Response Size: %dBytes\n", rp.Len())
 }
+
+func TestDefaultHeaders(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s", r.Header.Get("Authorization"), r.Header.Get("X-Tenant"))
+	}))
+	defer ts.Close()
+
+	c := DefaultHTTPClient()
+	c.DefaultHeaders = map[string]string{
+		"Authorization": "Bearer default",
+		"x-tenant":      "t1",
+	}
+
+	rp := bytes.NewBuffer(nil)
+	err := c.Get(&RequestArgs{
+		URL:         ts.URL,
+		Headers:     map[string]string{"X-Tenant": "t2"},
+		BytesResult: rp,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if rp.String() != "Bearer default|t2" {
+		t.Fatalf("Unexpected headers: %s", rp.String())
+	}
+}
+
+func TestStaticHosts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Host)
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+
+	c := DefaultHTTPClient()
+	c.SetStaticHosts(map[string]string{"upstream.invalid": u.Hostname()})
+
+	rp := bytes.NewBuffer(nil)
+	err := c.Get(&RequestArgs{
+		URL:         "http://upstream.invalid:" + u.Port(),
+		BytesResult: rp,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if rp.String() != "upstream.invalid:"+u.Port() {
+		t.Fatalf("Unexpected host: %s", rp.String())
+	}
+}
+
+func TestStaticHostsIgnoreProxy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "upstream")
+	}))
+	defer ts.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "proxy")
+	}))
+	defer proxy.Close()
+
+	for _, k := range []string{"HTTP_PROXY", "http_proxy"} {
+		old, ok := os.LookupEnv(k)
+		os.Setenv(k, proxy.URL)
+		defer func(k string) {
+			if ok {
+				os.Setenv(k, old)
+			} else {
+				os.Unsetenv(k)
+			}
+		}(k)
+	}
+
+	// 与beego默认的Transport一致，不读取环境变量中的代理
+	u, _ := url.Parse(ts.URL)
+	c := DefaultHTTPClient()
+	c.SetStaticHosts(map[string]string{"upstream.invalid": u.Hostname()})
+	rp := bytes.NewBuffer(nil)
+	if err := c.Get(&RequestArgs{URL: "http://upstream.invalid:" + u.Port(), BytesResult: rp}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if rp.String() != "upstream" {
+		t.Fatalf("Request should not go through proxy, got %q", rp.String())
+	}
+}
+
+func TestReuseConnAfterRWTimeout(t *testing.T) {
+	var conns int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c := DefaultHTTPClient()
+	c.RWTimeout = 200 * time.Millisecond
+	c.SetDNSCacheTTL(time.Minute)
+
+	// 连接建立超过RWTimeout后仍可复用，不应因建立时的期限而超时
+	for i := 0; i < 5; i++ {
+		if err := c.Get(&RequestArgs{URL: ts.URL}); err != nil {
+			t.Fatalf("(%d) %v", i, err)
+		}
+		time.Sleep(80 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("Expect 1 connection to be reused, but got %d", n)
+	}
+
+	// 空闲超过RWTimeout的连接被关闭，之后的请求使用新连接
+	time.Sleep(300 * time.Millisecond)
+	if err := c.Get(&RequestArgs{URL: ts.URL}); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestStalledBodyTimeout(t *testing.T) {
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1024")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	resolved := DefaultHTTPClient()
+	resolved.SetDNSCacheTTL(time.Minute)
+	// 只设置了CookieJar的客户端同样使用自定义的Transport
+	jarOnly := NewHTTPClientWithJar()
+
+	// 响应头已返回而响应体停滞时，同样受RWTimeout限制
+	for name, c := range map[string]*HTTPClient{"resolver": resolved, "jar": jarOnly} {
+		c.RWTimeout = 100 * time.Millisecond
+		start := time.Now()
+		err := c.Get(&RequestArgs{URL: ts.URL, BytesResult: bytes.NewBuffer(nil)})
+		if err == nil {
+			t.Fatalf("%s: request should time out", name)
+		}
+		if cost := time.Since(start); cost > time.Second {
+			t.Fatalf("%s: stalled body not timed out, cost %v, %v", name, cost, err)
+		}
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	var loops int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			fmt.Fprint(w, "login page")
+		case "/loop":
+			atomic.AddInt32(&loops, 1)
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		default:
+			http.Redirect(w, r, "/login", http.StatusFound)
+		}
+	}))
+	defer ts.Close()
+
+	// 默认跟随重定向，直接构造的客户端同样如此
+	c := DefaultHTTPClient()
+	for _, client := range []*HTTPClient{c, {ConnectTimeout: time.Second, RWTimeout: time.Second}} {
+		rp := bytes.NewBuffer(nil)
+		if err := client.Get(&RequestArgs{URL: ts.URL + "/home", BytesResult: rp}); err != nil {
+			t.Fatal(err.Error())
+		}
+		if rp.String() != "login page" {
+			t.Fatalf("Unexpected response: %s", rp.String())
+		}
+	}
+
+	// 限制跟随次数
+	c.MaxRedirects = 3
+	if err := c.Get(&RequestArgs{URL: ts.URL + "/loop"}); !errors.Is(err, ErrTooManyRedirects) {
+		t.Fatalf("Expect ErrTooManyRedirects, but got %v", err)
+	}
+	// 超过次数不会重试
+	if n := atomic.LoadInt32(&loops); n != 4 {
+		t.Fatalf("Expect 4 requests for 3 redirects, but got %d", n)
+	}
+
+	// 未设置MaxRedirects时最多跟随10次
+	c.MaxRedirects = 0
+	atomic.StoreInt32(&loops, 0)
+	if err := c.Get(&RequestArgs{URL: ts.URL + "/loop"}); !errors.Is(err, ErrTooManyRedirects) {
+		t.Fatalf("Expect ErrTooManyRedirects, but got %v", err)
+	}
+	if n := atomic.LoadInt32(&loops); n != 11 {
+		t.Fatalf("Expect 11 requests for default policy, but got %d", n)
+	}
+
+	// 不跟随时返回重定向地址
+	c.DisableRedirects = true
+	args := &RequestArgs{URL: ts.URL + "/home"}
+	if err := c.Get(args); err != nil {
+		t.Fatal(err.Error())
+	}
+	if args.Location != "/login" {
+		t.Fatalf("Unexpected location: %s", args.Location)
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	var current, peak int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&current, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&current, -1)
+	}))
+	defer ts.Close()
+
+	c := DefaultHTTPClient()
+	c.MaxConcurrent = 2
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Get(&RequestArgs{URL: ts.URL}); err != nil {
+				t.Error(err.Error())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak > 2 {
+		t.Fatalf("Peak concurrent %d > 2", peak)
+	}
+	if c.InFlight() != 0 {
+		t.Fatalf("InFlight %d != 0", c.InFlight())
+	}
+}
+
+func TestParseCurl(t *testing.T) {
+	cmd := `curl -s -X PUT 'http://127.0.0.1:8080/hosts/1' \
+		-H "Content-Type: application/json" \
+		-H 'X-Tenant: t1' \
+		-u admin:secret \
+		--data '{"name": "web 1"}'`
+
+	args, method, err := ParseCurl(cmd)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if method != "PUT" || args.URL != "http://127.0.0.1:8080/hosts/1" {
+		t.Fatalf("Unexpected method or url: %s %s", method, args.URL)
+	}
+	if args.Headers["Content-Type"] != "application/json" || args.Headers["X-Tenant"] != "t1" {
+		t.Fatalf("Unexpected headers: %v", args.Headers)
+	}
+	if args.Headers["Authorization"] != "Basic YWRtaW46c2VjcmV0" {
+		t.Fatalf("Unexpected authorization: %s", args.Headers["Authorization"])
+	}
+	if string(args.Body.([]byte)) != `{"name": "web 1"}` {
+		t.Fatalf("Unexpected body: %s", args.Body)
+	}
+
+	// 携带数据且未指定方法时为POST
+	if _, method, _ = ParseCurl(`curl http://127.0.0.1 -d a=1 -d b=2`); method != "POST" {
+		t.Fatalf("Unexpected method: %s", method)
+	}
+
+	// 小写的请求头不会被默认的Content-Type覆盖
+	args, _, err = ParseCurl(`curl http://127.0.0.1 -H 'content-type: application/json' -d '{}'`)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(args.Headers) != 1 || args.Headers["Content-Type"] != "application/json" {
+		t.Fatalf("Unexpected headers: %v", args.Headers)
+	}
+
+	for _, bad := range []string{`wget http://127.0.0.1`, `curl -X`, `curl -H 'bad' http://127.0.0.1`, `curl 'http://127.0.0.1`, `curl --unknown http://127.0.0.1`, `curl -s`} {
+		if _, _, err = ParseCurl(bad); err == nil {
+			t.Fatalf("Parse '%s' should fail", bad)
+		}
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := DefaultHTTPClient().Get(&RequestArgs{URL: ts.URL, Ctx: ctx})
+	if err != context.Canceled {
+		t.Fatalf("Expect context.Canceled, but got %v", err)
+	}
+	if cost := time.Since(start); cost > time.Second {
+		t.Fatalf("Canceled request cost %v", cost)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = DefaultHTTPClient().Get(&RequestArgs{URL: ts.URL, Ctx: ctx}); err != context.DeadlineExceeded {
+		t.Fatalf("Expect context.DeadlineExceeded, but got %v", err)
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/nocontent":
+			w.Header().Set("X-Request-Id", "abc")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Redirect(w, r, "/nocontent", http.StatusFound)
+		}
+	}))
+	defer ts.Close()
+
+	// SuccessCodes仅包含200时204视为失败，但仍返回状态码
+	c := DefaultHTTPClient()
+	c.SuccessCodes = []int{http.StatusOK}
+	args := &RequestArgs{URL: ts.URL + "/nocontent"}
+	if err := c.Get(args); err == nil {
+		t.Fatal("204 should fail when only 200 is accepted")
+	}
+	if args.StatusCode != http.StatusNoContent {
+		t.Fatalf("Unexpected status code %d", args.StatusCode)
+	}
+
+	var result struct{}
+	args = &RequestArgs{
+		URL:          ts.URL + "/nocontent",
+		JSONResult:   &result,
+		AcceptStatus: func(code int) bool { return code == 200 || code == 204 },
+	}
+	if err := c.Get(args); err != nil {
+		t.Fatal(err.Error())
+	}
+	if args.StatusCode != http.StatusNoContent || args.ResponseHeaders.Get("X-Request-Id") != "abc" {
+		t.Fatalf("Unexpected response %d %v", args.StatusCode, args.ResponseHeaders)
+	}
+
+	c.DisableRedirects = true
+	args = &RequestArgs{URL: ts.URL + "/home"}
+	if err := c.Get(args); err != nil {
+		t.Fatal(err.Error())
+	}
+	if args.StatusCode != http.StatusFound || args.ResponseHeaders.Get("Location") != "/nocontent" {
+		t.Fatalf("Unexpected response %d %v", args.StatusCode, args.ResponseHeaders)
+	}
+}
+
+func TestSuccessCodes(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id":1}`)
+	}))
+	defer ts.Close()
+
+	// 默认2xx均为成功
+	var result struct {
+		ID int `json:"id"`
+	}
+	c := DefaultHTTPClient()
+	if err := c.Post(&RequestArgs{URL: ts.URL, JSONResult: &result}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if result.ID != 1 {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+
+	c.SuccessCodes = []int{http.StatusOK}
+	err := c.Post(&RequestArgs{URL: ts.URL})
+	if err == nil || !strings.Contains(err.Error(), `{"id":1}`) {
+		t.Fatalf("Expect error with body, but got %v", err)
+	}
+}
+
+func TestUploadFile(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, fh, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		n, _ := io.Copy(ioutil.Discard, f)
+		fmt.Fprintf(w, "%s %s %d %s", r.Header.Get("Content-Type")[:19], fh.Filename, n, r.FormValue("owner"))
+	}))
+	defer ts.Close()
+
+	f, err := ioutil.TempFile("", "httplib-upload-*.txt")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("hello upload")
+	f.Close()
+
+	rp := bytes.NewBuffer(nil)
+	err = DefaultHTTPClient().Post(&RequestArgs{
+		URL:         ts.URL,
+		Files:       map[string]string{"file": f.Name()},
+		FormFields:  map[string]string{"owner": "zwf"},
+		BytesResult: rp,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expect := fmt.Sprintf("multipart/form-data %s 12 zwf", filepath.Base(f.Name()))
+	if rp.String() != expect {
+		t.Fatalf("Expect %q, but got %q", expect, rp.String())
+	}
+
+	err = DefaultHTTPClient().Post(&RequestArgs{
+		URL:   ts.URL,
+		Files: map[string]string{"file": f.Name() + ".notexist"},
+	})
+	if err == nil {
+		t.Fatal("Upload missing file should fail")
+	}
+}
+
+func TestFormBody(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%s %s %s", r.Header.Get("Content-Type"), r.PostForm.Get("name"), r.PostForm.Get("memo"))
+	}))
+	defer ts.Close()
+
+	rp := bytes.NewBuffer(nil)
+	err := DefaultHTTPClient().Post(&RequestArgs{
+		URL:         ts.URL,
+		FormBody:    map[string]string{"name": "zwf", "memo": "a&b=c"},
+		BytesResult: rp,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expect := "application/x-www-form-urlencoded zwf a&b=c"; rp.String() != expect {
+		t.Fatalf("Expect %q, but got %q", expect, rp.String())
+	}
+
+	err = DefaultHTTPClient().Post(&RequestArgs{
+		URL:      ts.URL,
+		FormBody: map[string]string{"name": "zwf"},
+		Body:     []byte("raw"),
+	})
+	if err == nil {
+		t.Fatal("FormBody with Body should fail")
+	}
+}
+
+func TestCloneRequestArgs(t *testing.T) {
+	type body struct {
+		Name string `json:"name"`
+	}
+	base := &RequestArgs{
+		URL:         "http://127.0.0.1/",
+		Headers:     map[string]string{"X-Token": "abc"},
+		Params:      map[string]string{"page": "1"},
+		Body:        &body{Name: "zwf"},
+		Filters:     []FilterFunc{func(args *RequestArgs) error { return nil }},
+		BytesResult: bytes.NewBuffer(nil),
+		WriteTo:     bytes.NewBuffer(nil),
+		StatusCode:  200,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := base.Clone()
+			c.Params["page"] = fmt.Sprint(i)
+			c.Headers["X-Index"] = fmt.Sprint(i)
+			c.Filters[0] = nil
+		}(i)
+	}
+	wg.Wait()
+
+	if base.Params["page"] != "1" || len(base.Headers) != 1 || base.Filters[0] == nil {
+		t.Fatalf("Base args was modified: %v %v", base.Params, base.Headers)
+	}
+
+	c := base.Clone()
+	if b, ok := c.Body.([]byte); !ok || string(b) != `{"name":"zwf"}` {
+		t.Fatalf("Unexpected cloned body: %v", c.Body)
+	}
+	base.Body.(*body).Name = "changed"
+	if string(c.Body.([]byte)) != `{"name":"zwf"}` {
+		t.Fatal("Cloned body shares memory with base")
+	}
+	if c.BytesResult != nil || c.JSONResult != nil || c.WriteTo != nil || c.StatusCode != 0 {
+		t.Fatal("Outputs should not be cloned")
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	const size = 3 << 20
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+		io.Copy(w, io.LimitReader(zeroReader{}, size))
+	}))
+	defer ts.Close()
+
+	f, err := ioutil.TempFile("", "httplib-download-*")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	args := &RequestArgs{URL: ts.URL + "/file", WriteTo: f}
+	if err = DefaultHTTPClient().Get(args); err != nil {
+		t.Fatal(err.Error())
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if fmt.Sprint(fi.Size()) != args.ResponseHeaders.Get("Content-Length") {
+		t.Fatalf("Expect %s bytes, but got %d", args.ResponseHeaders.Get("Content-Length"), fi.Size())
+	}
+
+	// 状态码校验失败时不写入
+	rp := bytes.NewBuffer(nil)
+	if err = DefaultHTTPClient().Get(&RequestArgs{URL: ts.URL + "/missing", WriteTo: rp}); err == nil {
+		t.Fatal("404 should fail")
+	}
+	if rp.Len() != 0 {
+		t.Fatalf("Unexpected body written: %s", rp.String())
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func TestRetryBackoff(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1)%3 != 0 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	// 失败两次后成功，默认退避为[50ms, 100ms) + [100ms, 200ms)
+	c := DefaultHTTPClient()
+	c.Retry = 2
+	rp := bytes.NewBuffer(nil)
+	start := time.Now()
+	if err := c.Get(&RequestArgs{URL: ts.URL, BytesResult: rp}); err != nil {
+		t.Fatal(err.Error())
+	}
+	cost := time.Since(start)
+	if rp.String() != "ok" || atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("Unexpected result %q after %d calls", rp.String(), calls)
+	}
+	if cost < 150*time.Millisecond || cost > 2*time.Second {
+		t.Fatalf("Elapsed time %v does not match backoff", cost)
+	}
+
+	// 默认不重试POST
+	atomic.StoreInt32(&calls, 0)
+	if err := c.Post(&RequestArgs{URL: ts.URL}); err == nil {
+		t.Fatal("POST should fail without retry")
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("POST should not be retried, but called %d times", n)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	c.RetryPost = true
+	c.RetryBackoff = func(attempt int) time.Duration { return time.Millisecond }
+	if err := c.Post(&RequestArgs{URL: ts.URL}); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	for attempt := 0; attempt < 20; attempt++ {
+		d := DefaultRetryBackoff(attempt)
+		if d <= 0 || d > maxRetryBackoff {
+			t.Fatalf("Backoff for attempt %d out of range: %v", attempt, d)
+		}
+	}
+}
+
+func TestOnRetry(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	var attempts []int
+	c := DefaultHTTPClient()
+	c.Retry = 5
+	c.RetryBackoff = func(attempt int) time.Duration { return time.Millisecond }
+	c.OnRetry = func(attempt int, method, url string, err error) {
+		if method != http.MethodGet || url != ts.URL || err == nil {
+			t.Errorf("Unexpected retry event: %s %s %v", method, url, err)
+		}
+		attempts = append(attempts, attempt)
+	}
+	if err := c.Get(&RequestArgs{URL: ts.URL}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if fmt.Sprint(attempts) != "[0 1]" {
+		t.Fatalf("Expect retry events [0 1], but got %v", attempts)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, `{"method":%q,"body":%q}`, r.Method, b)
+	}))
+	defer ts.Close()
+
+	var result struct {
+		Method string `json:"method"`
+		Body   string `json:"body"`
+	}
+	err := DefaultHTTPClient().Patch(&RequestArgs{
+		URL:        ts.URL,
+		Body:       map[string]interface{}{"name": "zwf", "age": 18},
+		JSONResult: &result,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if result.Method != http.MethodPatch || result.Body != `{"age":18,"name":"zwf"}` {
+		t.Fatalf("Unexpected result %+v", result)
+	}
+}
+
+func TestParamsMulti(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.RawQuery)
+	}))
+	defer ts.Close()
+
+	rp := bytes.NewBuffer(nil)
+	err := DefaultHTTPClient().Get(&RequestArgs{
+		URL:         ts.URL,
+		Params:      map[string]string{"page": "1"},
+		ParamsMulti: map[string][]string{"id": {"1", "2"}},
+		BytesResult: rp,
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	query, err := url.ParseQuery(rp.String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if fmt.Sprint(query["id"]) != "[1 2]" || query.Get("page") != "1" {
+		t.Fatalf("Unexpected raw query %q", rp.String())
+	}
+}
+
+func TestAuth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Header.Get("Authorization"))
+	}))
+	defer ts.Close()
+
+	for _, c := range []struct {
+		args   *RequestArgs
+		expect string
+	}{
+		{&RequestArgs{BasicAuth: &BasicAuth{User: "zwf", Pass: "secret"}}, "Basic endmOnNlY3JldA=="},
+		{&RequestArgs{BearerToken: "token"}, "Bearer token"},
+		{&RequestArgs{BasicAuth: &BasicAuth{User: "zwf", Pass: "secret"}, BearerToken: "token"}, "Bearer token"},
+	} {
+		rp := bytes.NewBuffer(nil)
+		c.args.URL = ts.URL
+		c.args.BytesResult = rp
+		if err := DefaultHTTPClient().Get(c.args); err != nil {
+			t.Fatal(err.Error())
+		}
+		if rp.String() != c.expect {
+			t.Fatalf("Expect Authorization %q, but got %q", c.expect, rp.String())
+		}
+	}
+}
+
+func TestResponseFilters(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprint(w, `{"ok":true}`)
+	}))
+	defer ts.Close()
+
+	var order []string
+	var status int
+	var result struct {
+		OK bool `json:"ok"`
+	}
+	args := &RequestArgs{
+		URL:          ts.URL,
+		JSONResult:   &result,
+		AcceptStatus: func(code int) bool { return code == http.StatusAccepted },
+		ResponseFilters: []ResponseFilterFunc{
+			func(args *RequestArgs, rp *http.Response) error {
+				order = append(order, "first")
+				status = rp.StatusCode
+				return nil
+			},
+			func(args *RequestArgs, rp *http.Response) error {
+				order = append(order, "second")
+				return nil
+			},
+		},
+	}
+	if err := DefaultHTTPClient().Get(args); err != nil {
+		t.Fatal(err.Error())
+	}
+	if status != http.StatusAccepted || fmt.Sprint(order) != "[first second]" || !result.OK {
+		t.Fatalf("Unexpected filter result: status=%d order=%v result=%+v", status, order, result)
+	}
+
+	// 过滤器返回错误时中止解析
+	result.OK = false
+	args.ResponseFilters = []ResponseFilterFunc{
+		func(args *RequestArgs, rp *http.Response) error { return errors.New("circuit open") },
+	}
+	if err := DefaultHTTPClient().Get(args); err == nil {
+		t.Fatal("Response filter error should abort")
+	}
+	if result.OK {
+		t.Fatal("Body should not be parsed after filter error")
+	}
+}
+
+func TestDecompression(t *testing.T) {
+	const data = `{"name":"zwf"}`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gzip":
+			w.Header().Set("Content-Encoding", "gzip")
+			zw := gzip.NewWriter(w)
+			zw.Write([]byte(data))
+			zw.Close()
+		case "/deflate":
+			w.Header().Set("Content-Encoding", "deflate")
+			zw := zlib.NewWriter(w)
+			zw.Write([]byte(data))
+			zw.Close()
+		case "/empty":
+			w.Header().Set("Content-Encoding", "gzip")
+		case "/empty-deflate":
+			w.Header().Set("Content-Encoding", "deflate")
+		}
+	}))
+	defer ts.Close()
+
+	// 显式携带Accept-Encoding时net/http不会自动解压
+	headers := map[string]string{"Accept-Encoding": "gzip, deflate"}
+	for _, path := range []string{"/gzip", "/deflate"} {
+		var result struct {
+			Name string `json:"name"`
+		}
+		if err := DefaultHTTPClient().Get(&RequestArgs{URL: ts.URL + path, Headers: headers, JSONResult: &result}); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if result.Name != "zwf" {
+			t.Fatalf("%s: unexpected result %+v", path, result)
+		}
+	}
+
+	rp := bytes.NewBuffer(nil)
+	for _, path := range []string{"/empty", "/empty-deflate"} {
+		if err := DefaultHTTPClient().Get(&RequestArgs{URL: ts.URL + path, Headers: headers, BytesResult: rp}); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if rp.Len() != 0 {
+			t.Fatalf("%s: unexpected body %q", path, rp.String())
+		}
+	}
+
+	// 未显式携带Accept-Encoding时同样返回原始字节
+	c := DefaultHTTPClient()
+	c.DisableDecompression = true
+	if err := c.Get(&RequestArgs{URL: ts.URL + "/gzip", BytesResult: rp}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if rp.String() == data || !bytes.HasPrefix(rp.Bytes(), []byte{0x1f, 0x8b}) {
+		t.Fatalf("Expect raw gzip bytes, but got %q", rp.String())
+	}
+}
+
+func TestRequestOverrides(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "slow")
+	}))
+	defer ts.Close()
+
+	c := DefaultHTTPClient()
+	c.Retry = 3
+	c.RetryBackoff = func(attempt int) time.Duration { return time.Millisecond }
+
+	timeout, retry := time.Millisecond, 0
+	start := time.Now()
+	err := c.Get(&RequestArgs{URL: ts.URL, RWTimeout: &timeout, Retry: &retry})
+	if err == nil {
+		t.Fatal("Request should time out")
+	}
+	if cost := time.Since(start); cost > 150*time.Millisecond {
+		t.Fatalf("Per-request timeout not applied, cost %v, %v", cost, err)
+	}
+	if n := atomic.LoadInt32(&calls); n > 1 {
+		t.Fatalf("Per-request retry not applied, called %d times", n)
+	}
+
+	// 未覆盖时使用客户端配置
+	if err = c.Get(&RequestArgs{URL: ts.URL}); err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestRequestOverridesReuseConn(t *testing.T) {
+	var conns int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c := NewHTTPClientWithJar()
+	c.SetDNSCacheTTL(time.Minute)
+
+	// 相同的超时时间共用Transport，连接可以复用
+	timeout := 2 * time.Second
+	for i := 0; i < 3; i++ {
+		if err := c.Get(&RequestArgs{URL: ts.URL, RWTimeout: &timeout}); err != nil {
+			t.Fatalf("(%d) %v", i, err)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("Expect 1 connection to be reused, but got %d", n)
+	}
+	if err := c.Get(&RequestArgs{URL: ts.URL}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := len(c.transports); n != 2 {
+		t.Fatalf("Expect 2 cached transports, but got %d", n)
+	}
+}
+
+func TestCookieJar(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+		default:
+			if ck, err := r.Cookie("session"); err == nil {
+				fmt.Fprint(w, ck.Value)
+			}
+		}
+	}))
+	defer ts.Close()
+
+	c := NewHTTPClientWithJar()
+	if err := c.Get(&RequestArgs{URL: ts.URL + "/login"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	rp := bytes.NewBuffer(nil)
+	if err := c.Get(&RequestArgs{URL: ts.URL + "/me", BytesResult: rp}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if rp.String() != "abc" {
+		t.Fatalf("Expect session cookie abc, but got %q", rp.String())
+	}
+
+	// 没有CookieJar的客户端不携带Cookie
+	rp.Reset()
+	if err := DefaultHTTPClient().Get(&RequestArgs{URL: ts.URL + "/me", BytesResult: rp}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if rp.Len() != 0 {
+		t.Fatalf("Unexpected cookie %q", rp.String())
+	}
+}
+
+func TestLatency(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		fmt.Fprint(w, "ok")
+	}))
+	defer ts.Close()
+
+	var hooked time.Duration
+	c := DefaultHTTPClient()
+	c.MetricsHook = func(method, url string, status int, d time.Duration) {
+		if method != http.MethodGet || url != ts.URL || status != http.StatusOK {
+			t.Errorf("Unexpected metrics event: %s %s %d", method, url, status)
+		}
+		hooked = d
+	}
+	args := &RequestArgs{URL: ts.URL}
+	if err := c.Get(args); err != nil {
+		t.Fatal(err.Error())
+	}
+	if args.Latency < delay {
+		t.Fatalf("Expect latency >= %v, but got %v", delay, args.Latency)
+	}
+	if hooked != args.Latency {
+		t.Fatalf("Expect hook latency %v, but got %v", args.Latency, hooked)
+	}
+	if args.Clone().Latency != 0 {
+		t.Fatal("Expect cloned latency to be reset")
+	}
+}
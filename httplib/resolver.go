@@ -0,0 +1,157 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httplib
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resolver 支持静态hosts与缓存的域名解析
+type resolver struct {
+	mutex sync.RWMutex
+
+	// 静态的域名到IP的映射，优先级最高
+	static map[string]string
+
+	// 解析结果的缓存时长，<=0表示不缓存
+	ttl time.Duration
+
+	// 解析结果缓存
+	cache map[string]resolveEntry
+}
+
+type resolveEntry struct {
+	addrs  []string
+	expire time.Time
+}
+
+func newResolver() *resolver {
+	return &resolver{
+		static: make(map[string]string),
+		cache:  make(map[string]resolveEntry),
+	}
+}
+
+func (r *resolver) setStatic(hosts map[string]string) {
+	static := make(map[string]string, len(hosts))
+	for host, ip := range hosts {
+		static[strings.ToLower(host)] = ip
+	}
+
+	r.mutex.Lock()
+	r.static = static
+	r.mutex.Unlock()
+}
+
+func (r *resolver) setTTL(ttl time.Duration) {
+	r.mutex.Lock()
+	r.ttl = ttl
+	r.cache = make(map[string]resolveEntry)
+	r.mutex.Unlock()
+}
+
+// lookup 解析host，依次查找静态hosts、缓存、系统DNS
+func (r *resolver) lookup(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	key := strings.ToLower(host)
+
+	r.mutex.RLock()
+	ip, isStatic := r.static[key]
+	entry, cached := r.cache[key]
+	ttl := r.ttl
+	r.mutex.RUnlock()
+
+	if isStatic {
+		return []string{ip}, nil
+	}
+	if cached && time.Now().Before(entry.expire) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		r.mutex.Lock()
+		r.cache[key] = resolveEntry{addrs: addrs, expire: time.Now().Add(ttl)}
+		r.mutex.Unlock()
+	}
+	return addrs, nil
+}
+
+// dialer 返回使用该resolver解析域名的DialContext，连接超时为connectTimeout
+// 与beego的TimeoutDialer一样为连接设置rwTimeout的读写期限，但连接会被Transport复用，
+// 因此每次读写时顺延期限，而不是在建立时设置固定的期限
+func (r *resolver) dialer(connectTimeout, rwTimeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := r.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		d := net.Dialer{Timeout: connectTimeout}
+		var lastErr error
+		for _, ip := range addrs {
+			conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if rwTimeout > 0 {
+				conn = &deadlineConn{Conn: conn, timeout: rwTimeout}
+			}
+			return conn, nil
+		}
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no address found for %s", host)
+		}
+		return nil, lastErr
+	}
+}
+
+// deadlineConn 每次读写前将连接的期限设置为timeout之后
+// 写入请求时会同时顺延Transport后台等待响应的读取，因此等待响应头、读取响应体
+// 停滞超过timeout时都会超时，而空闲的连接超过timeout后由Transport关闭
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gziputil 各包共用的gzip压缩工具
+package gziputil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/Hurricanezwf/pkg/pool/bytesbuffer"
+)
+
+// Encode 以level(见compress/gzip)压缩fn写入的数据并输出到w
+// gzip头部的修改时间为0且不包含文件名和注释，相同的输入总是得到相同的字节
+func Encode(w io.Writer, level int, fn func(w io.Writer) error) error {
+	gw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return err
+	}
+	if err = fn(gw); err != nil {
+		gw.Close()
+		return err
+	}
+	// Close会写入剩余的压缩数据及gzip尾部
+	return gw.Close()
+}
+
+// Decode 解压r中的一个gzip流并交给fn读取，不处理该流之后的数据
+// r未实现io.ByteReader时可能越过流末尾读取
+func Decode(r io.Reader, fn func(r io.Reader) error) error {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+	gr.Multistream(false)
+	return fn(gr)
+}
+
+// Compress 以level压缩data，见Encode
+func Compress(data []byte, level int) ([]byte, error) {
+	buf := bytesbuffer.Get()
+	defer bytesbuffer.Put(buf)
+
+	err := Encode(buf, level, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// Decompress 解压Compress的结果
+func Decompress(compressed []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gziputil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	data := bytes.Repeat([]byte("hello gziputil "), 100)
+	compressed, err := Compress(data, gzip.BestSpeed)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	again, err := Compress(data, gzip.BestSpeed)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(compressed, again) {
+		t.Fatal("Compress should be deterministic")
+	}
+	raw, err := Decompress(compressed)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(raw, data) {
+		t.Fatal("Decompressed data mismatch")
+	}
+
+	if _, err = Compress(data, 10); err == nil {
+		t.Fatal("Invalid level should fail")
+	}
+}
+
+func TestDecodeSingleStream(t *testing.T) {
+	var buf bytes.Buffer
+	for _, s := range []string{"first", "second"} {
+		err := Encode(&buf, gzip.DefaultCompression, func(w io.Writer) error {
+			_, err := io.WriteString(w, s)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// bytes.Buffer实现了io.ByteReader，逐个读取两个流
+	for _, want := range []string{"first", "second"} {
+		var got []byte
+		err := Decode(&buf, func(r io.Reader) (err error) {
+			got, err = ioutil.ReadAll(r)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(got) != want {
+			t.Fatalf("Decode got %q, want %q", got, want)
+		}
+	}
+}
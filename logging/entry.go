@@ -0,0 +1,76 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Entry 携带一组键值对的日志记录器，输出的每行日志都以这些键值对为前缀，
+// 便于将同一请求的日志串联起来(如request_id)。Entry是只读的，可在多个goroutine中共享
+type Entry struct {
+	fields map[string]interface{}
+	prefix string
+}
+
+// WithFields 返回携带fields的Entry，输出格式为"k1=v1 k2=v2 msg"，键按字典序排列
+func WithFields(fields map[string]interface{}) *Entry {
+	return (&Entry{}).WithFields(fields)
+}
+
+// WithFields 返回在当前键值对基础上追加fields的新Entry，相同的键以fields为准
+func (e *Entry) WithFields(fields map[string]interface{}) *Entry {
+	merged := make(map[string]interface{}, len(e.fields)+len(fields))
+	for k, v := range e.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+
+	keys := make([]string, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%v ", k, merged[k])
+	}
+	return &Entry{fields: merged, prefix: b.String()}
+}
+
+// Debug 输出Debug级别日志
+func (e *Entry) Debug(format string, v ...interface{}) {
+	output(levelDebug, e.prefix+fmt.Sprintf(format, v...))
+}
+
+// Info 输出Info级别日志
+func (e *Entry) Info(format string, v ...interface{}) {
+	output(levelInfo, e.prefix+fmt.Sprintf(format, v...))
+}
+
+// Warn 输出Warn级别日志
+func (e *Entry) Warn(format string, v ...interface{}) {
+	output(levelWarn, e.prefix+fmt.Sprintf(format, v...))
+}
+
+// Error 输出Error级别日志
+func (e *Entry) Error(format string, v ...interface{}) {
+	output(levelError, e.prefix+fmt.Sprintf(format, v...))
+}
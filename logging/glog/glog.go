@@ -73,9 +73,11 @@ package glog
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"hash"
 	"io"
 	stdLog "log"
 	"os"
@@ -86,6 +88,8 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/Hurricanezwf/pkg/cryptolib"
 )
 
 // severity identifies the sort of log: info, warning etc. It also implements
@@ -415,6 +419,21 @@ func Flush() {
 	logging.lockAndFlushAll()
 }
 
+// Reconfigure 原子地切换日志输出配置
+// 已打开的日志文件会被刷盘并关闭，之后的日志按照新配置输出；
+// 整个切换过程持有日志锁，切换期间的日志不会丢失或重复写入。
+// dir为空时日志文件写入系统临时目录
+func Reconfigure(toStderr bool, dir string, verbosity Level) {
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+
+	logging.closeFiles()
+	logging.toStderr = toStderr
+	setLogDir(dir)
+	logging.stderrThreshold.set(errorLog)
+	logging.setVState(verbosity, logging.vmodule.filter, false)
+}
+
 // loggingT collects all the global state of the logging setup.
 type loggingT struct {
 	// Boolean flags. Not handled atomically because the flag.Value interface
@@ -426,6 +445,12 @@ type loggingT struct {
 	// Level flag. Handled atomically.
 	stderrThreshold severity // The -stderrthreshold flag.
 
+	// jsonFormat 非0时每条日志输出为一行JSON，原子读写
+	jsonFormat int32
+
+	// splitByLevel 为true时每条日志只写入自身级别的文件，不再同时写入更低级别的文件，受mu保护
+	splitByLevel bool
+
 	// freeList is a list of byte buffers, maintained under freeListMu.
 	freeList *buffer
 	// freeListMu maintains the free list. It is separate from the main mutex
@@ -453,6 +478,8 @@ type loggingT struct {
 	// safely using atomic.LoadInt32.
 	vmodule   moduleSpec // The state of the -vmodule flag.
 	verbosity Level      // V logging level, the value of the -v flag/
+	// sealKey 非空时轮转出的日志文件末尾追加HMAC，见SetSealKey
+	sealKey []byte
 }
 
 // buffer holds a byte Buffer for reuse. The zero value is ready for use.
@@ -460,6 +487,7 @@ type buffer struct {
 	bytes.Buffer
 	tmp  [64]byte // temporary byte array for creating headers.
 	next *buffer
+	json bool // 为true时只包含消息内容，输出前转换为JSON
 }
 
 var logging loggingT
@@ -556,6 +584,9 @@ func (l *loggingT) formatHeader(s severity, file string, line int) *buffer {
 		s = infoLog // for safety.
 	}
 	buf := l.getBuffer()
+	if buf.json = atomic.LoadInt32(&l.jsonFormat) != 0; buf.json {
+		return buf
+	}
 
 	// Avoid Fprintf, for speed. The format is so simple that we can do it quickly by hand.
 	// It's worth about 3X. Fprintf is hard.
@@ -667,6 +698,48 @@ func (l *loggingT) printWithFileLine(s severity, file string, line int, alsoToSt
 	l.output(s, buf, file, line, alsoToStderr)
 }
 
+// jsonLine JSON格式的日志行
+type jsonLine struct {
+	Level  string `json:"level"`
+	Ts     string `json:"ts"`
+	Msg    string `json:"msg"`
+	Caller string `json:"caller"`
+}
+
+// SetFormatJSON 设置是否以JSON格式输出日志，每条日志一行，包含level、ts、msg及caller字段
+func SetFormatJSON(enable bool) {
+	var v int32
+	if enable {
+		v = 1
+	}
+	atomic.StoreInt32(&logging.jsonFormat, v)
+}
+
+// SetSplitByLevel 设置是否按级别拆分日志文件
+// 默认情况下高级别的日志会同时写入所有更低级别的文件(如ERROR日志也出现在INFO文件中)，
+// 开启后每条日志只写入自身级别的文件
+func SetSplitByLevel(enable bool) {
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	logging.splitByLevel = enable
+}
+
+// formatJSON 将buf中的消息内容替换为JSON格式的日志行
+func formatJSON(buf *buffer, s severity, file string, line int) {
+	b, err := json.Marshal(jsonLine{
+		Level:  severityName[s],
+		Ts:     timeNow().Format(time.RFC3339Nano),
+		Msg:    strings.TrimSuffix(buf.String(), "\n"),
+		Caller: file + ":" + strconv.Itoa(line),
+	})
+	if err != nil {
+		return
+	}
+	buf.Reset()
+	buf.Write(b)
+	buf.WriteByte('\n')
+}
+
 // output writes the data to the log files and releases the buffer.
 func (l *loggingT) output(s severity, buf *buffer, file string, line int, alsoToStderr bool) {
 	l.mu.Lock()
@@ -675,6 +748,9 @@ func (l *loggingT) output(s severity, buf *buffer, file string, line int, alsoTo
 			buf.Write(stacks(false))
 		}
 	}
+	if buf.json {
+		formatJSON(buf, s, file, line)
+	}
 	data := buf.Bytes()
 	if !flag.Parsed() {
 		os.Stderr.Write([]byte("ERROR: logging before flag.Parse: "))
@@ -691,18 +767,22 @@ func (l *loggingT) output(s severity, buf *buffer, file string, line int, alsoTo
 				l.exit(err)
 			}
 		}
-		switch s {
-		case fatalLog:
-			l.file[fatalLog].Write(data)
-			fallthrough
-		case errorLog:
-			l.file[errorLog].Write(data)
-			fallthrough
-		case warningLog:
-			l.file[warningLog].Write(data)
-			fallthrough
-		case infoLog:
-			l.file[infoLog].Write(data)
+		if l.splitByLevel {
+			l.file[s].Write(data)
+		} else {
+			switch s {
+			case fatalLog:
+				l.file[fatalLog].Write(data)
+				fallthrough
+			case errorLog:
+				l.file[errorLog].Write(data)
+				fallthrough
+			case warningLog:
+				l.file[warningLog].Write(data)
+				fallthrough
+			case infoLog:
+				l.file[infoLog].Write(data)
+			}
 		}
 	}
 	if s == fatalLog {
@@ -804,7 +884,8 @@ type syncBuffer struct {
 	*bufio.Writer
 	file   *os.File
 	sev    severity
-	nbytes uint64 // The number of bytes written to this file
+	nbytes uint64    // The number of bytes written to this file
+	mac    hash.Hash // 当前文件内容的HMAC，未开启签名时为nil
 }
 
 func (sb *syncBuffer) Sync() error {
@@ -819,24 +900,39 @@ func (sb *syncBuffer) Write(p []byte) (n int, err error) {
 	}
 	n, err = sb.Writer.Write(p)
 	sb.nbytes += uint64(n)
+	if sb.mac != nil {
+		sb.mac.Write(p[:n])
+	}
 	if err != nil {
 		sb.logger.exit(err)
 	}
 	return
 }
 
+// close 刷盘并关闭当前文件，开启签名时先追加签名行
+func (sb *syncBuffer) close() {
+	sb.Flush()
+	if sb.mac != nil {
+		sb.file.Write(sealTrailer(sb.mac))
+	}
+	sb.file.Close()
+}
+
 // rotateFile closes the syncBuffer's file and starts a new one.
 func (sb *syncBuffer) rotateFile(now time.Time) error {
 	if sb.file != nil {
-		sb.Flush()
-		sb.file.Close()
+		sb.close()
 	}
 	var err error
 	sb.file, _, err = create(severityName[sb.sev], now)
 	sb.nbytes = 0
+	sb.mac = nil
 	if err != nil {
 		return err
 	}
+	if len(sb.logger.sealKey) > 0 {
+		sb.mac = cryptolib.NewMAC(sb.logger.sealKey)
+	}
 
 	sb.Writer = bufio.NewWriterSize(sb.file, bufferSize)
 
@@ -848,6 +944,9 @@ func (sb *syncBuffer) rotateFile(now time.Time) error {
 	fmt.Fprintf(&buf, "Log line format: [IWEF]mmdd hh:mm:ss.uuuuuu threadid file:line] msg\n")
 	n, err := sb.file.Write(buf.Bytes())
 	sb.nbytes += uint64(n)
+	if sb.mac != nil {
+		sb.mac.Write(buf.Bytes()[:n])
+	}
 	return err
 }
 
@@ -893,6 +992,22 @@ func (l *loggingT) lockAndFlushAll() {
 	l.mu.Unlock()
 }
 
+// closeFiles 关闭所有日志文件，下次输出时将重新创建
+// l.mu is held.
+func (l *loggingT) closeFiles() {
+	for s := fatalLog; s >= infoLog; s-- {
+		switch file := l.file[s].(type) {
+		case nil:
+			continue
+		case *syncBuffer:
+			file.close()
+		default:
+			file.Flush()
+		}
+		l.file[s] = nil
+	}
+}
+
 // flushAll flushes all the logs and attempts to "sync" their data to disk.
 // l.mu is held.
 func (l *loggingT) flushAll() {
@@ -1105,6 +1220,16 @@ func Error(args ...interface{}) {
 	logging.print(errorLog, args...)
 }
 
+// PrintWithFileLine 使用指定的文件名及行号输出日志，用于异步输出等无法从调用栈获取位置的场景
+// sev为INFO、WARNING或ERROR，其它取值按INFO处理
+func PrintWithFileLine(sev string, file string, line int, args ...interface{}) {
+	s, ok := severityByName(sev)
+	if !ok || s > errorLog {
+		s = infoLog
+	}
+	logging.printWithFileLine(s, file, line, false, args...)
+}
+
 // ErrorDepth acts as Error but uses depth to determine which call frame to log.
 // ErrorDepth(0, "msg") is the same as Error("msg").
 func ErrorDepth(depth int, args ...interface{}) {
@@ -19,20 +19,34 @@
 package glog
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
+	"hash"
+	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/Hurricanezwf/pkg/cryptolib"
 )
 
 // MaxSize is the maximum size of a log file in bytes.
 var MaxSize uint64 = 1024 * 1024 * 1800
 
+// SetMaxSize 设置单个日志文件的最大字节数，超过后轮转到新文件
+func SetMaxSize(n uint64) {
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	MaxSize = n
+}
+
 // logDirs lists the candidate directories for new log files.
 var logDirs []string
 
@@ -47,6 +61,15 @@ func createLogDirs() {
 	logDirs = append(logDirs, os.TempDir())
 }
 
+// setLogDir 修改日志目录，只对之后新建的日志文件生效
+// l.mu is held.
+func setLogDir(dir string) {
+	onceLogDirs.Do(func() {})
+	*logDir = dir
+	logDirs = nil
+	createLogDirs()
+}
+
 var (
 	pid      = os.Getpid()
 	program  = filepath.Base(os.Args[0])
@@ -110,15 +133,71 @@ func create(tag string, t time.Time) (f *os.File, filename string, err error) {
 	name, link := logName(tag, t)
 	var lastErr error
 	for _, dir := range logDirs {
-		fname := filepath.Join(dir, name)
-		f, err := os.Create(fname)
+		f, fname, err := createUnique(filepath.Join(dir, name))
 		if err == nil {
 			symlink := filepath.Join(dir, link)
-			os.Remove(symlink)        // ignore err
-			os.Symlink(name, symlink) // ignore err
+			os.Remove(symlink)                        // ignore err
+			os.Symlink(filepath.Base(fname), symlink) // ignore err
 			return f, fname, nil
 		}
 		lastErr = err
 	}
 	return nil, "", fmt.Errorf("log: cannot create log: %v", lastErr)
 }
+
+// createUnique 创建新文件，同一秒内重复创建(如切换配置后)时文件名已存在，
+// 此时依次追加.1、.2等后缀，避免截断已有日志
+func createUnique(fname string) (*os.File, string, error) {
+	name := fname
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil || !os.IsExist(err) || i > 1000 {
+			return f, name, err
+		}
+		name = fmt.Sprintf("%s.%d", fname, i)
+	}
+}
+
+// SealPrefix 签名行的前缀，签名行位于轮转后日志文件的最后一行
+const SealPrefix = "#HMAC-SHA256 "
+
+// SetSealKey 开启日志签名，key为空时关闭
+// 开启后，每个日志文件在轮转关闭时末尾追加一行HMAC(见cryptolib.NewMAC)，可用VerifyFile校验。
+// 只对之后新建的日志文件生效，正在写入(尚未轮转)的文件没有签名行，无法校验。
+func SetSealKey(key []byte) {
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	logging.sealKey = append([]byte(nil), key...)
+}
+
+// sealTrailer 生成签名行
+func sealTrailer(mac hash.Hash) []byte {
+	return []byte(SealPrefix + hex.EncodeToString(mac.Sum(nil)) + "\n")
+}
+
+// VerifyFile 校验轮转后日志文件末尾的HMAC
+// 内容被篡改或key不匹配时返回cryptolib.ErrIntegrity
+func VerifyFile(path string, key []byte) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// 签名行为最后一行
+	i := bytes.LastIndexByte(bytes.TrimSuffix(data, []byte("\n")), '\n') + 1
+	line := bytes.TrimSuffix(data[i:], []byte("\n"))
+	if !bytes.HasPrefix(line, []byte(SealPrefix)) {
+		return errors.New("log: missing HMAC trailer")
+	}
+	sum, err := hex.DecodeString(string(line[len(SealPrefix):]))
+	if err != nil {
+		return fmt.Errorf("log: bad HMAC trailer, %v", err)
+	}
+
+	mac := cryptolib.NewMAC(key)
+	mac.Write(data[:i])
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return cryptolib.ErrIntegrity
+	}
+	return nil
+}
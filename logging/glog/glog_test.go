@@ -19,13 +19,17 @@ package glog
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	stdLog "log"
+	"os"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/Hurricanezwf/pkg/cryptolib"
 )
 
 // Test that shortHostname works as advertised.
@@ -371,6 +375,52 @@ func TestRollover(t *testing.T) {
 	}
 }
 
+func TestSealedRotation(t *testing.T) {
+	key := []byte("seal-key")
+	sb := &syncBuffer{
+		logger: &loggingT{sealKey: key},
+		sev:    infoLog,
+	}
+
+	now := time.Now()
+	if err := sb.rotateFile(now); err != nil {
+		t.Fatal(err)
+	}
+	fname0 := sb.file.Name()
+	defer os.Remove(fname0)
+	sb.Write([]byte("I0101 00:00:00.000000 1 test.go:1] hello\n"))
+
+	if err := sb.rotateFile(now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	fname1 := sb.file.Name()
+	defer os.Remove(fname1)
+	defer sb.file.Close()
+
+	if err := VerifyFile(fname0, key); err != nil {
+		t.Fatalf("VerifyFile failed, %v", err)
+	}
+	if err := VerifyFile(fname0, []byte("other-key")); err != cryptolib.ErrIntegrity {
+		t.Fatalf("Expect ErrIntegrity with wrong key, but got %v", err)
+	}
+	// 正在写入的文件没有签名行
+	if err := VerifyFile(fname1, key); err == nil {
+		t.Fatal("Active file should not verify")
+	}
+
+	data, err := ioutil.ReadFile(fname0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = bytes.Replace(data, []byte("hello"), []byte("hellx"), 1)
+	if err = ioutil.WriteFile(fname0, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyFile(fname0, key); err != cryptolib.ErrIntegrity {
+		t.Fatalf("Expect ErrIntegrity after tampering, but got %v", err)
+	}
+}
+
 func TestLogBacktraceAt(t *testing.T) {
 	setFlags()
 	defer logging.swap(logging.newBuffers())
@@ -21,9 +21,10 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strconv"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Hurricanezwf/pkg/logging/glog"
@@ -34,24 +35,59 @@ const (
 	LogWayFile    = "file"
 )
 
+// 日志格式
+const (
+	LogFormatPlain = "plain" // glog默认格式
+	LogFormatJSON  = "json"  // 每条日志一行JSON，包含level、ts、msg及caller字段
+)
+
 var (
 	mutex   sync.RWMutex
 	logWay  string        = LogWayConsole
 	logDir  string        = ""
 	verbose int           = 1
+	format  string        = LogFormatPlain
+	minLvl  int           = levelDebug
 	expire  time.Duration = time.Duration(7 * 24 * time.Hour)
+
+	cleanInterval   time.Duration = 5 * time.Minute
+	cleanBatchLimit int           = 5
+	cleanUpdated                  = make(chan struct{}, 1) // 清理间隔变化时通知cleanDaemon
+
+	stopC    = make(chan struct{})
+	stopOnce sync.Once
+	cleanWg  sync.WaitGroup
+
+	asyncC       chan asyncRecord // 非nil时日志经由该通道异步输出，受mutex保护
+	asyncWg      sync.WaitGroup
+	asyncBlocked uint64 // 因缓冲区已满而阻塞的写入次数，原子读写
 )
 
 func init() {
 	reset(logWay, logDir, verbose)
+	cleanWg.Add(1)
 	go cleanDaemon()
 }
 
+// Stop 停止日志清理任务，关闭异步输出并将缓冲的日志刷盘，可重复调用
+// 停止后仍可继续(同步地)写日志，但过期日志不再被清理
+func Stop() {
+	stopOnce.Do(func() {
+		close(stopC)
+	})
+	cleanWg.Wait()
+	SetAsync(0)
+	glog.Flush()
+}
+
+// Reset 切换日志配置，新配置原子地生效，切换期间的日志不会丢失或重复写入
 func Reset(logway, logdir string, verboselevel int) (err error) {
 	if err = reset(logway, logdir, verboselevel); err != nil {
 		return err
 	}
-	flag.Parse() // do apply to glog
+	if !flag.Parsed() {
+		flag.Parse() // glog在flag解析之前不会输出到日志文件
+	}
 	return nil
 }
 
@@ -62,7 +98,6 @@ func reset(logway, logdir string, verboselevel int) (err error) {
 
 	switch logway {
 	case LogWayConsole:
-		flag.Set("logtostderr", "true")
 	case LogWayFile:
 		if len(logdir) <= 0 {
 			return errors.New("Missing logDir when you want to log into file")
@@ -73,23 +108,171 @@ func reset(logway, logdir string, verboselevel int) (err error) {
 		if err = os.MkdirAll(logdir, os.ModePerm); err != nil {
 			return fmt.Errorf("Create log dir failed, %v", err)
 		}
-		flag.Set("logtostderr", "false")
-		flag.Set("log_dir", logdir)
 	default:
 		return fmt.Errorf("Unknown logway(%s)", logway)
 	}
 
 	mutex.Lock()
+	defer mutex.Unlock()
+
 	logWay = logway
 	logDir = logdir
-	verbose = verbose
-	mutex.Unlock()
+	verbose = verboselevel
+	glog.Reconfigure(logway == LogWayConsole, logdir, glog.Level(verboselevel))
+	return nil
+}
+
+// 日志级别，对应DebugWriter、InfoWriter、WarnWriter及ErrorWriter
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+// SetMinLevel 设置输出的最低级别("debug"|"info"|"warn"|"error")，低于该级别的日志直接丢弃
+// 与glog的v参数相互独立，默认为"debug"
+func SetMinLevel(level string) error {
+	for lvl, name := range levelNames {
+		if name == level {
+			mutex.Lock()
+			minLvl = lvl
+			mutex.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown log level(%s)", level)
+}
+
+func MinLevel() string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return levelNames[minLvl]
+}
+
+// asyncRecord 异步模式下排队等待输出的日志
+type asyncRecord struct {
+	sev  string
+	file string
+	line int
+	msg  string
+}
+
+// SetAsync 开启异步输出，日志先写入容量为bufferSize的缓冲区，由后台goroutine输出，
+// bufferSize为0时关闭异步输出。切换时会先输出完已缓冲的日志，不会丢失。
+// 缓冲区满时写日志的调用方将阻塞等待而不是丢弃日志，阻塞次数可通过AsyncBlocked查看。
+// 注意: 日志中的时间为实际输出的时间，而非调用时间
+func SetAsync(bufferSize int) error {
+	if bufferSize < 0 {
+		return errors.New("logging: Async buffer size should be >= 0")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if asyncC != nil {
+		close(asyncC)
+		asyncWg.Wait()
+		asyncC = nil
+	}
+	if bufferSize > 0 {
+		asyncC = make(chan asyncRecord, bufferSize)
+		asyncWg.Add(1)
+		go drain(asyncC)
+	}
+	return nil
+}
+
+// AsyncBlocked 返回异步模式下因缓冲区已满而阻塞的写入次数
+func AsyncBlocked() uint64 {
+	return atomic.LoadUint64(&asyncBlocked)
+}
+
+// drain 输出异步缓冲区中的日志，直到通道被关闭
+func drain(c <-chan asyncRecord) {
+	defer asyncWg.Done()
+	for r := range c {
+		glog.PrintWithFileLine(r.sev, r.file, r.line, r.msg)
+	}
+}
+
+// output 按级别输出日志，调用链为 调用方 -> Println等 -> output
+func output(level int, msg string) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	if level < minLvl {
+		return
+	}
+
+	if asyncC == nil {
+		switch level {
+		case levelWarn:
+			glog.WarningDepth(2, msg)
+		case levelError:
+			glog.ErrorDepth(2, msg)
+		default:
+			glog.InfoDepth(2, msg)
+		}
+		return
+	}
+
+	r := asyncRecord{sev: "INFO", msg: msg}
+	switch level {
+	case levelWarn:
+		r.sev = "WARNING"
+	case levelError:
+		r.sev = "ERROR"
+	}
+	var ok bool
+	if _, r.file, r.line, ok = runtime.Caller(2); ok {
+		r.file = filepath.Base(r.file)
+	} else {
+		r.file, r.line = "???", 1
+	}
+
+	// 持有读锁发送，保证SetAsync关闭通道时没有正在进行的发送
+	select {
+	case asyncC <- r:
+	default:
+		atomic.AddUint64(&asyncBlocked, 1)
+		asyncC <- r
+	}
+}
+
+// SetSplitByLevel 设置是否按级别拆分日志文件，仅在LogWayFile时有意义
+// 开启后INFO文件只包含Debug及Info日志，WARNING、ERROR文件分别只包含对应级别的日志
+func SetSplitByLevel(enable bool) {
+	glog.SetSplitByLevel(enable)
+}
 
-	flag.Set("stderrthreshold", "ERROR")
-	flag.Set("v", strconv.Itoa(verboselevel))
+// SetFormat 设置日志格式，默认为LogFormatPlain
+func SetFormat(f string) error {
+	switch f {
+	case LogFormatPlain, LogFormatJSON:
+	default:
+		return fmt.Errorf("Unknown log format(%s)", f)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	format = f
+	glog.SetFormatJSON(f == LogFormatJSON)
 	return nil
 }
 
+func Format() string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return format
+}
+
 func LogWayOK(logway string) bool {
 	mutex.RLock()
 	defer mutex.RUnlock()
@@ -106,6 +289,55 @@ func SetExpire(v time.Duration) error {
 	return nil
 }
 
+// SetMaxFileSize 设置单个日志文件的最大字节数，超过后轮转到新文件
+// 轮转后的旧文件同样按照Expire定期清理
+func SetMaxFileSize(bytes int64) error {
+	if bytes <= 0 {
+		return errors.New("logging: Max file size should be greater than 0")
+	}
+	glog.SetMaxSize(uint64(bytes))
+	return nil
+}
+
+// SetCleanInterval 设置过期日志的清理间隔，最小为1秒，正在运行的清理任务会立即使用新的间隔
+func SetCleanInterval(v time.Duration) error {
+	if v < time.Second {
+		return errors.New("logging: Clean interval should be greater than 1 second")
+	}
+	mutex.Lock()
+	cleanInterval = v
+	mutex.Unlock()
+
+	select {
+	case cleanUpdated <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func CleanInterval() time.Duration {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return cleanInterval
+}
+
+// SetCleanBatchLimit 设置每次最多清理的日志文件数，最小为1
+func SetCleanBatchLimit(n int) error {
+	if n < 1 {
+		return errors.New("logging: Clean batch limit should be greater than 0")
+	}
+	mutex.Lock()
+	cleanBatchLimit = n
+	mutex.Unlock()
+	return nil
+}
+
+func CleanBatchLimit() int {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return cleanBatchLimit
+}
+
 func Expire() time.Duration {
 	mutex.RLock()
 	defer mutex.RUnlock()
@@ -124,58 +356,89 @@ func LogDir() string {
 	return logDir
 }
 
+func Verbose() int {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return verbose
+}
+
+// SetSealKey 开启防篡改日志，key为空时关闭
+// 每个日志文件轮转时末尾会追加一行基于key的HMAC，可通过VerifyLog校验。
+// 注意: key的生成与保管由调用方负责；正在写入(尚未轮转)的日志文件没有签名，不受保护。
+func SetSealKey(key []byte) {
+	glog.SetSealKey(key)
+}
+
+// VerifyLog 校验轮转后日志文件的HMAC，内容被篡改时返回cryptolib.ErrIntegrity
+func VerifyLog(path string, key []byte) error {
+	return glog.VerifyFile(path, key)
+}
+
 // 定期清理日志
 func cleanDaemon() {
-	batchLimit := 5
-	toRemove := make([]string, 0, batchLimit)
+	defer cleanWg.Done()
 
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
+	ticker := time.NewTicker(CleanInterval())
+	defer func() { ticker.Stop() }()
 
-	for range ticker.C {
-		if LogWay() != LogWayFile {
-			continue
+	for {
+		select {
+		case <-stopC:
+			return
+		case <-ticker.C:
+			clean()
+		case <-cleanUpdated:
+			ticker.Stop()
+			ticker = time.NewTicker(CleanInterval())
 		}
+	}
+}
+
+// clean 清理过期日志, 每次清理总数目受到CleanBatchLimit限制
+func clean() {
+	if LogWay() != LogWayFile {
+		return
+	}
 
-		// 筛选出需要清理的日志, 每次清理总数目受到batchLimit限制
-		// 可清理的日志需满足以下条件:
-		// (1) 过期
-		// (2) 具备文件名中具备.log的关键字
-		// (3) 具备写权限
-		toRemove = toRemove[:0]
-		keepDuration := Expire()
-		dir := LogDir()
-
-		files, err := ioutil.ReadDir(dir)
-		if err != nil {
-			glog.Warning(err.Error())
+	// 筛选出需要清理的日志
+	// 可清理的日志需满足以下条件:
+	// (1) 过期
+	// (2) 具备文件名中具备.log的关键字
+	// (3) 具备写权限
+	batchLimit := CleanBatchLimit()
+	toRemove := make([]string, 0, batchLimit)
+	keepDuration := Expire()
+	dir := LogDir()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		glog.Warning(err.Error())
+		return
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		modeTime := f.ModTime()
+		if time.Since(modeTime) < keepDuration {
+			continue
+		}
+		if strings.Contains(f.Name(), ".log") == false {
 			continue
 		}
-		for _, f := range files {
-			if f.IsDir() {
-				continue
-			}
-			modeTime := f.ModTime()
-			if time.Since(modeTime) < keepDuration {
-				continue
-			}
-			if strings.Contains(f.Name(), ".log") == false {
-				continue
-			}
-			if (f.Mode() & 0200) == 0 {
-				continue
-			}
-			toRemove = append(toRemove, filepath.Join(dir, f.Name()))
-			if len(toRemove) >= batchLimit {
-				break
-			}
+		if (f.Mode() & 0200) == 0 {
+			continue
 		}
+		toRemove = append(toRemove, filepath.Join(dir, f.Name()))
+		if len(toRemove) >= batchLimit {
+			break
+		}
+	}
 
-		for _, f := range toRemove {
-			if err := os.Remove(f); err != nil {
-				glog.Warningf("Clean %s failed, %v", f, err)
-				continue
-			}
+	for _, f := range toRemove {
+		if err := os.Remove(f); err != nil {
+			glog.Warningf("Clean %s failed, %v", f, err)
+			continue
 		}
 	}
 }
@@ -184,28 +447,28 @@ func cleanDaemon() {
 type DebugWriter struct{}
 
 func (w DebugWriter) Println(format string, v ...interface{}) {
-	glog.InfoDepth(1, fmt.Sprintf(format, v...))
+	output(levelDebug, fmt.Sprintf(format, v...))
 }
 
 // InfoWriter 输出Info级别日志
 type InfoWriter struct{}
 
 func (w InfoWriter) Println(format string, v ...interface{}) {
-	glog.InfoDepth(1, fmt.Sprintf(format, v...))
+	output(levelInfo, fmt.Sprintf(format, v...))
 }
 
 // WarnWriter 输出Warn级别日志
 type WarnWriter struct{}
 
 func (w WarnWriter) Println(format string, v ...interface{}) {
-	glog.WarningDepth(1, fmt.Sprintf(format, v...))
+	output(levelWarn, fmt.Sprintf(format, v...))
 }
 
 // ErrorWriter 输出Error级别日志
 type ErrorWriter struct{}
 
 func (w ErrorWriter) Println(format string, v ...interface{}) {
-	glog.ErrorDepth(1, fmt.Sprintf(format, v...))
+	output(levelError, fmt.Sprintf(format, v...))
 }
 
 // 如需更详细的级别，可直接使用glog.V(n).Infof()
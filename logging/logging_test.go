@@ -0,0 +1,445 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Hurricanezwf/pkg/logging/glog"
+)
+
+func TestResetWhileLogging(t *testing.T) {
+	root, err := ioutil.TempDir("", "logging-reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer Reset(LogWayConsole, "", 1)
+
+	dirs := []string{filepath.Join(root, "a"), filepath.Join(root, "b")}
+	if err = Reset(LogWayFile, dirs[0], 1); err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, lines = 4, 200
+	var wg sync.WaitGroup
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < lines; i++ {
+				InfoWriter{}.Println("msg-%d-%d.", g, i)
+			}
+		}(g)
+	}
+
+	// 写日志的同时在两个目录之间来回切换
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+		default:
+			if err := Reset(LogWayFile, dirs[i%2], 1); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		break
+	}
+	glog.Flush()
+
+	// 每行日志恰好出现一次
+	var content strings.Builder
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range files {
+			if f.Mode()&os.ModeSymlink != 0 || !strings.Contains(f.Name(), ".log.INFO.") {
+				continue
+			}
+			b, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			content.Write(b)
+		}
+	}
+	all := content.String()
+	for g := 0; g < writers; g++ {
+		for i := 0; i < lines; i++ {
+			if n := strings.Count(all, fmt.Sprintf("msg-%d-%d.", g, i)); n != 1 {
+				t.Fatalf("Line msg-%d-%d appears %d times", g, i, n)
+			}
+		}
+	}
+}
+
+func TestVerbose(t *testing.T) {
+	defer Reset(LogWayConsole, "", 1)
+
+	if err := Reset(LogWayConsole, "", 3); err != nil {
+		t.Fatal(err)
+	}
+	if v := Verbose(); v != 3 {
+		t.Fatalf("Expect verbose 3, but got %d", v)
+	}
+}
+
+func TestMaxFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging-size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer Reset(LogWayConsole, "", 1)
+	defer SetMaxFileSize(int64(glog.MaxSize))
+
+	if err = SetMaxFileSize(0); err == nil {
+		t.Fatal("Max file size 0 should fail")
+	}
+	if err = SetMaxFileSize(4096); err != nil {
+		t.Fatal(err)
+	}
+	if err = Reset(LogWayFile, dir, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 200; i++ {
+		InfoWriter{}.Println("size-%d %s", i, strings.Repeat("x", 64))
+	}
+	glog.Flush()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, f := range files {
+		if f.Mode()&os.ModeSymlink != 0 || !strings.Contains(f.Name(), ".log.INFO.") {
+			continue
+		}
+		if f.Size() > 4096+1024 {
+			t.Fatalf("File %s is too large, %d bytes", f.Name(), f.Size())
+		}
+		count++
+	}
+	if count < 2 {
+		t.Fatalf("Expect multiple log files, but got %d", count)
+	}
+}
+
+func TestFormatJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging-json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer Reset(LogWayConsole, "", 1)
+	defer SetFormat(LogFormatPlain)
+
+	if err = SetFormat("xml"); err == nil {
+		t.Fatal("Unknown format should fail")
+	}
+	if err = SetFormat(LogFormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	if err = Reset(LogWayFile, dir, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	WarnWriter{}.Println("hello %s, %d", "json", 1)
+	glog.Flush()
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, filepath.Base(os.Args[0])+".WARNING"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	var line struct {
+		Level  string `json:"level"`
+		Ts     string `json:"ts"`
+		Msg    string `json:"msg"`
+		Caller string `json:"caller"`
+	}
+	if err = json.Unmarshal([]byte(lines[len(lines)-1]), &line); err != nil {
+		t.Fatalf("Unmarshal log line failed, %v", err)
+	}
+	if line.Level != "WARNING" || line.Msg != "hello json, 1" || !strings.HasPrefix(line.Caller, "logging_test.go:") {
+		t.Fatalf("Unexpected log line %+v", line)
+	}
+	if _, err = time.Parse(time.RFC3339Nano, line.Ts); err != nil {
+		t.Fatalf("Bad ts %q, %v", line.Ts, err)
+	}
+}
+
+func TestCleanDaemon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging-clean")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer Reset(LogWayConsole, "", 1)
+	defer SetCleanBatchLimit(CleanBatchLimit())
+	defer SetCleanInterval(CleanInterval())
+
+	if err = SetCleanInterval(time.Millisecond); err == nil {
+		t.Fatal("Clean interval 1ms should fail")
+	}
+	if err = SetCleanBatchLimit(0); err == nil {
+		t.Fatal("Clean batch limit 0 should fail")
+	}
+
+	old := time.Now().Add(-30 * 24 * time.Hour)
+	for i := 0; i < 6; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("old-%d.log", i))
+		if err = ioutil.WriteFile(name, []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Chtimes(name, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fresh := filepath.Join(dir, "fresh.log")
+	if err = ioutil.WriteFile(fresh, []byte("fresh"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = Reset(LogWayFile, dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = SetCleanBatchLimit(3); err != nil {
+		t.Fatal(err)
+	}
+	if err = SetCleanInterval(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// 每次最多清理3个，两轮后应全部清理完毕
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		matches, _ := filepath.Glob(filepath.Join(dir, "old-*.log"))
+		if len(matches) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expired logs are not cleaned, %v", matches)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if _, err = os.Stat(fresh); err != nil {
+		t.Fatalf("Fresh log should be kept, %v", err)
+	}
+}
+
+func TestSplitByLevel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging-split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer Reset(LogWayConsole, "", 1)
+	defer SetSplitByLevel(false)
+
+	SetSplitByLevel(true)
+	if err = Reset(LogWayFile, dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	InfoWriter{}.Println("split-info")
+	ErrorWriter{}.Println("split-error")
+	glog.Flush()
+
+	read := func(sev string) string {
+		b, err := ioutil.ReadFile(filepath.Join(dir, filepath.Base(os.Args[0])+"."+sev))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	info, errs := read("INFO"), read("ERROR")
+	if !strings.Contains(errs, "split-error") || strings.Contains(errs, "split-info") {
+		t.Fatalf("Unexpected ERROR file:\n%s", errs)
+	}
+	if !strings.Contains(info, "split-info") || strings.Contains(info, "split-error") {
+		t.Fatalf("Unexpected INFO file:\n%s", info)
+	}
+}
+
+func TestWithFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging-fields")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer Reset(LogWayConsole, "", 1)
+
+	if err = Reset(LogWayFile, dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	entry := WithFields(map[string]interface{}{"request_id": "abc", "uid": 1})
+	entry.Info("fields-%d", 1)
+	entry.WithFields(map[string]interface{}{"uid": 2}).Warn("fields-%d", 2)
+	InfoWriter{}.Println("fields-%d", 3)
+	glog.Flush()
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, filepath.Base(os.Args[0])+".INFO"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(b)
+	for _, expect := range []string{"] request_id=abc uid=1 fields-1", "] request_id=abc uid=2 fields-2", "] fields-3"} {
+		if !strings.Contains(content, expect) {
+			t.Fatalf("Missing %q in:\n%s", expect, content)
+		}
+	}
+}
+
+func TestMinLevel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging-level")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer Reset(LogWayConsole, "", 1)
+	defer SetMinLevel("debug")
+
+	if err = SetMinLevel("trace"); err == nil {
+		t.Fatal("Unknown level should fail")
+	}
+	if err = SetMinLevel("warn"); err != nil {
+		t.Fatal(err)
+	}
+	if l := MinLevel(); l != "warn" {
+		t.Fatalf("Expect min level warn, but got %s", l)
+	}
+	if err = Reset(LogWayFile, dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	DebugWriter{}.Println("level-debug")
+	InfoWriter{}.Println("level-info")
+	WithFields(map[string]interface{}{"k": "v"}).Info("level-entry")
+	WarnWriter{}.Println("level-warn")
+	glog.Flush()
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, filepath.Base(os.Args[0])+".INFO"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(b)
+	if !strings.Contains(content, "level-warn") {
+		t.Fatalf("Missing warn log in:\n%s", content)
+	}
+	for _, unexpect := range []string{"level-debug", "level-info", "level-entry"} {
+		if strings.Contains(content, unexpect) {
+			t.Fatalf("Unexpected %q in:\n%s", unexpect, content)
+		}
+	}
+}
+
+func TestAsync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging-async")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer Reset(LogWayConsole, "", 1)
+
+	if err = SetAsync(-1); err == nil {
+		t.Fatal("Negative buffer size should fail")
+	}
+	if err = Reset(LogWayFile, dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	// 缓冲区较小，写入时会阻塞但不应丢失
+	if err = SetAsync(8); err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, lines = 4, 500
+	var wg sync.WaitGroup
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < lines; i++ {
+				InfoWriter{}.Println("async-%d-%d.", g, i)
+			}
+		}(g)
+	}
+	wg.Wait()
+	// 关闭异步输出以写完缓冲区中的日志，不调用Stop以免影响其它用例
+	if err = SetAsync(0); err != nil {
+		t.Fatal(err)
+	}
+	glog.Flush()
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, filepath.Base(os.Args[0])+".INFO"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(b)
+	for g := 0; g < writers; g++ {
+		for i := 0; i < lines; i++ {
+			if n := strings.Count(content, fmt.Sprintf("async-%d-%d.", g, i)); n != 1 {
+				t.Fatalf("Line async-%d-%d appears %d times", g, i, n)
+			}
+		}
+	}
+	if !strings.Contains(content, "logging_test.go:") {
+		t.Fatalf("Async log should keep the caller, got:\n%s", content[:200])
+	}
+	t.Logf("%d writes blocked", AsyncBlocked())
+}
+
+// TestStop 停止后清理任务不可恢复，需放在最后执行
+func TestStop(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		Stop()
+		Stop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop timeout")
+	}
+
+	// 清理任务已退出，再次等待立即返回
+	exited := make(chan struct{})
+	go func() {
+		cleanWg.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("Clean daemon is still running")
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongo
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// NewFake 返回一个基于内存的Interface实现，仅用于单元测试
+// 查询条件仅支持顶层字段的相等匹配，更新仅支持整体替换以及$set/$unset
+func NewFake() Interface {
+	return &fakeMongo{
+		data: make(map[string][]bson.M),
+	}
+}
+
+type fakeMongo struct {
+	mutex sync.RWMutex
+
+	// 以"db.collection"为键存储文档
+	data map[string][]bson.M
+}
+
+func (m *fakeMongo) Open(conf *Config) error {
+	return nil
+}
+
+func (m *fakeMongo) Close() error {
+	return nil
+}
+
+func (m *fakeMongo) Ping() error {
+	return nil
+}
+
+func (m *fakeMongo) Reconnect() error {
+	return nil
+}
+
+func (m *fakeMongo) Find(db, collection string, query bson.M, result interface{}) error {
+	rv := reflect.ValueOf(result)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return errors.New("result must be a slice address")
+	}
+
+	q, err := toM(query)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	slice := reflect.MakeSlice(rv.Elem().Type(), 0, 0)
+	for _, doc := range m.data[fullName(db, collection)] {
+		if !match(doc, q) {
+			continue
+		}
+		elem := reflect.New(rv.Elem().Type().Elem())
+		if err = convert(doc, elem.Interface()); err != nil {
+			return err
+		}
+		slice = reflect.Append(slice, elem.Elem())
+	}
+	rv.Elem().Set(slice)
+	return nil
+}
+
+func (m *fakeMongo) FindOne(db, collection string, query bson.M, result interface{}) error {
+	q, err := toM(query)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, doc := range m.data[fullName(db, collection)] {
+		if match(doc, q) {
+			return convert(doc, result)
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *fakeMongo) Insert(db, collection string, docs ...interface{}) error {
+	toInsert := make([]bson.M, 0, len(docs))
+	for _, d := range docs {
+		doc, err := toM(d)
+		if err != nil {
+			return err
+		}
+		if _, exist := doc["_id"]; !exist {
+			doc["_id"] = bson.NewObjectId()
+		}
+		toInsert = append(toInsert, doc)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name := fullName(db, collection)
+	for _, doc := range toInsert {
+		for _, existed := range m.data[name] {
+			if reflect.DeepEqual(existed["_id"], doc["_id"]) {
+				return &mgo.LastError{Code: 11000, Err: fmt.Sprintf("duplicate key %v", doc["_id"])}
+			}
+		}
+		m.data[name] = append(m.data[name], doc)
+	}
+	return nil
+}
+
+func (m *fakeMongo) Update(db, collection string, selector bson.M, update interface{}) error {
+	q, err := toM(selector)
+	if err != nil {
+		return err
+	}
+	u, err := toM(update)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	docs := m.data[fullName(db, collection)]
+	for i, doc := range docs {
+		if !match(doc, q) {
+			continue
+		}
+		updated, err := applyUpdate(doc, u)
+		if err != nil {
+			return err
+		}
+		docs[i] = updated
+		return nil
+	}
+	return ErrNotFound
+}
+
+func (m *fakeMongo) Remove(db, collection string, selector bson.M) error {
+	q, err := toM(selector)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	name := fullName(db, collection)
+	docs := m.data[name]
+	for i, doc := range docs {
+		if match(doc, q) {
+			m.data[name] = append(docs[:i], docs[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// GetSession 内存实现中不存在真实的session, 总是返回nil session和非nil的错误
+func (m *fakeMongo) GetSession() (*mgo.Session, error) {
+	return nil, errors.New("mongo: fake has no session")
+}
+
+func (m *fakeMongo) GetSessionWithMode(mode mgo.Mode) (*mgo.Session, error) {
+	return m.GetSession()
+}
+
+func (m *fakeMongo) PutSession(s *mgo.Session) {}
+
+func (m *fakeMongo) WithSession(fn func(s *mgo.Session) error) error {
+	_, err := m.GetSession()
+	return err
+}
+
+func (m *fakeMongo) Stats() Stats {
+	return Stats{}
+}
+
+func fullName(db, collection string) string {
+	return db + "." + collection
+}
+
+// toM 通过bson编解码将v转换为bson.M, 使得字段值的类型与从数据库中读出的一致
+func toM(v interface{}) (bson.M, error) {
+	m := bson.M{}
+	if v == nil {
+		return m, nil
+	}
+	if err := convert(v, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func convert(in, out interface{}) error {
+	b, err := bson.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(b, out)
+}
+
+func match(doc, query bson.M) bool {
+	for k, v := range query {
+		if !reflect.DeepEqual(doc[k], v) {
+			return false
+		}
+	}
+	return true
+}
+
+func applyUpdate(doc, update bson.M) (bson.M, error) {
+	var hasOperator bool
+	for k := range update {
+		if strings.HasPrefix(k, "$") {
+			hasOperator = true
+			break
+		}
+	}
+
+	// 整体替换，保留原有的_id
+	if !hasOperator {
+		replaced := bson.M{"_id": doc["_id"]}
+		for k, v := range update {
+			replaced[k] = v
+		}
+		return replaced, nil
+	}
+
+	updated := bson.M{}
+	for k, v := range doc {
+		updated[k] = v
+	}
+	for op, v := range update {
+		fields, ok := v.(bson.M)
+		if !ok {
+			return nil, fmt.Errorf("Bad value for update operator '%s'", op)
+		}
+		switch op {
+		case "$set":
+			for k, fv := range fields {
+				updated[k] = fv
+			}
+		case "$unset":
+			for k := range fields {
+				delete(updated, k)
+			}
+		default:
+			return nil, fmt.Errorf("Update operator '%s' is not supported by fake", op)
+		}
+	}
+	return updated, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongo
+
+import (
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+type host struct {
+	ID   string `bson:"_id"`
+	Name string `bson:"name"`
+	Zone string `bson:"zone"`
+}
+
+func TestFake(t *testing.T) {
+	m := NewFake()
+
+	err := m.Insert("cmdb", "host", &host{ID: "h1", Name: "web1", Zone: "bj"}, &host{ID: "h2", Name: "web2", Zone: "bj"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	var hosts []host
+	if err = m.Find("cmdb", "host", bson.M{"zone": "bj"}, &hosts); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(hosts) != 2 {
+		t.Fatalf("Found %d hosts, expect 2\n", len(hosts))
+	}
+
+	if err = m.Update("cmdb", "host", bson.M{"_id": "h1"}, bson.M{"$set": bson.M{"zone": "sh"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	var h host
+	if err = m.FindOne("cmdb", "host", bson.M{"_id": "h1"}, &h); err != nil {
+		t.Fatal(err.Error())
+	}
+	if h.Zone != "sh" || h.Name != "web1" {
+		t.Fatalf("Unexpected host after update: %#v\n", h)
+	}
+
+	if err = m.Remove("cmdb", "host", bson.M{"_id": "h2"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = m.FindOne("cmdb", "host", bson.M{"_id": "h2"}, &h); err != ErrNotFound {
+		t.Fatalf("Expect ErrNotFound, but got %v\n", err)
+	}
+}
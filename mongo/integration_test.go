@@ -0,0 +1,157 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration
+// +build integration
+
+// 基于真实MongoDB的集成测试，需通过integration构建标签启用:
+//
+//	docker run -d --name mongo -p 27017:27017 mongo:3.6
+//	MONGO_ADDR=127.0.0.1:27017 go test -tags integration -v ./mongo
+//
+// 未设置MONGO_ADDR时所有用例将被跳过。
+
+package mongo
+
+import (
+	"os"
+	"testing"
+
+	mgo "gopkg.in/mgo.v2"
+)
+
+func openIntegration(t *testing.T) *mongoV1 {
+	return openIntegrationWith(t, func(*Config) {})
+}
+
+// openIntegrationWith 以setup修改默认配置后打开
+func openIntegrationWith(t *testing.T, setup func(*Config)) *mongoV1 {
+	addr := os.Getenv("MONGO_ADDR")
+	if len(addr) <= 0 {
+		t.Skip("MONGO_ADDR is not set")
+	}
+
+	conf := DefaultConfig([]string{addr})
+	setup(conf)
+	m := newMongoV1().(*mongoV1)
+	if err := m.Open(conf); err != nil {
+		t.Fatalf("Open mongo failed, %v", err)
+	}
+	return m
+}
+
+func TestIntegrationReconnect(t *testing.T) {
+	m := openIntegration(t)
+	defer m.Close()
+
+	if err := m.Ping(); err != nil {
+		t.Fatalf("Ping should succeed after open, %v", err)
+	}
+
+	// 关闭根session模拟连接失效
+	m.rootSession.Close()
+	if err := m.Ping(); err == nil {
+		t.Fatal("Ping should fail after root session closed")
+	}
+
+	if err := m.Reconnect(); err != nil {
+		t.Fatalf("Reconnect failed, %v", err)
+	}
+	if err := m.Ping(); err != nil {
+		t.Fatalf("Ping should succeed after reconnect, %v", err)
+	}
+	if err := m.Insert("mongo_integration", "reconnect", map[string]string{"name": "web1"}); err != nil {
+		t.Fatalf("Insert after reconnect failed, %v", err)
+	}
+}
+
+func TestIntegrationMode(t *testing.T) {
+	mode := mgo.SecondaryPreferred
+	m := openIntegrationWith(t, func(conf *Config) {
+		conf.Mode = &mode
+	})
+	defer m.Close()
+
+	s, err := m.GetSession()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer m.PutSession(s)
+	if s.Mode() != mgo.SecondaryPreferred {
+		t.Fatalf("Expect mode %v, but got %v", mgo.SecondaryPreferred, s.Mode())
+	}
+
+	s2, err := m.GetSessionWithMode(mgo.Monotonic)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer m.PutSession(s2)
+	if s2.Mode() != mgo.Monotonic {
+		t.Fatalf("Expect mode %v, but got %v", mgo.Monotonic, s2.Mode())
+	}
+}
+
+func TestIntegrationStats(t *testing.T) {
+	m := openIntegration(t)
+	defer m.Close()
+
+	var sessions []*mgo.Session
+	for i := 0; i < 3; i++ {
+		s, err := m.GetSession()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		sessions = append(sessions, s)
+	}
+	if st := m.Stats(); st.Active != 3 || st.Total != 3 {
+		t.Fatalf("Unexpected stats %+v", st)
+	}
+
+	for _, s := range sessions {
+		m.PutSession(s)
+	}
+	if err := m.Insert("mongo_integration", "stats", map[string]string{"name": "web1"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if st := m.Stats(); st.Active != 0 || st.Total != 4 {
+		t.Fatalf("Unexpected stats %+v", st)
+	}
+}
+
+func TestIntegrationWithSession(t *testing.T) {
+	m := openIntegration(t)
+	defer m.Close()
+
+	err := m.WithSession(func(s *mgo.Session) error {
+		return s.DB("mongo_integration").C("with_session").Insert(map[string]string{"name": "web1"})
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// fn panic后session仍被释放，panic继续向上传播
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Fatalf("Expect panic boom, but got %v", r)
+			}
+		}()
+		m.WithSession(func(s *mgo.Session) error {
+			panic("boom")
+		})
+	}()
+	if st := m.Stats(); st.Active != 0 || st.Total != 2 {
+		t.Fatalf("Session should be released after panic, %+v", st)
+	}
+}
@@ -15,13 +15,23 @@
 package mongo
 
 import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
 var (
 	ErrNotFound = mgo.ErrNotFound
+
+	// ErrNotOpened 在Open之前或Close之后使用
+	ErrNotOpened = errors.New("mongo: not opened")
 )
 
 type Interface interface {
@@ -31,11 +41,52 @@ type Interface interface {
 	// Close 关闭MongoDriver
 	Close() error
 
+	// Ping 检查与Mongo的连接是否正常
+	Ping() error
+
+	// Reconnect Ping失败时使用Open时的配置重新连接，连接正常时不做任何操作
+	Reconnect() error
+
+	// Find 查询满足query的全部文档，result必须是slice的指针
+	Find(db, collection string, query bson.M, result interface{}) error
+
+	// FindOne 查询满足query的一个文档，未找到时返回ErrNotFound
+	FindOne(db, collection string, query bson.M, result interface{}) error
+
+	// Insert 插入一个或多个文档
+	Insert(db, collection string, docs ...interface{}) error
+
+	// Update 更新满足selector的一个文档，未找到时返回ErrNotFound
+	Update(db, collection string, selector bson.M, update interface{}) error
+
+	// Remove 删除满足selector的一个文档，未找到时返回ErrNotFound
+	Remove(db, collection string, selector bson.M) error
+
 	// GetSession 获取一个session, 这里的GetSession采用的是Copy的方式
-	GetSession() *mgo.Session
+	// 常规的增删改查请优先使用上面的方法，便于在单元测试中替换为NewFake。
+	// 在Open之前或Close之后调用时返回ErrNotOpened
+	GetSession() (*mgo.Session, error)
+
+	// GetSessionWithMode 获取一个使用指定一致性模式的session，忽略Config.Mode
+	GetSessionWithMode(mode mgo.Mode) (*mgo.Session, error)
 
 	// PutSession 释放一个session
 	PutSession(s *mgo.Session)
+
+	// WithSession 获取一个session并传给fn，fn返回或panic后都会释放该session，panic将继续向上传播
+	WithSession(fn func(s *mgo.Session) error) error
+
+	// Stats 返回session的使用统计，用于排查GetSession之后未PutSession的泄漏
+	Stats() Stats
+}
+
+// Stats session使用统计
+type Stats struct {
+	// Active 已获取但尚未释放的session数目
+	Active int
+
+	// Total 累计获取的session数目
+	Total int64
 }
 
 func New() Interface {
@@ -44,11 +95,36 @@ func New() Interface {
 
 type Config struct {
 	mgo.DialInfo
+
+	// SlowThreshold 慢查询阈值，耗时超过该值的操作将写入SlowLog (可选)
+	// 0表示不记录慢查询
+	SlowThreshold time.Duration
+
+	// SlowLog 慢查询日志写入，查询条件仅记录字段名，不记录具体的值
+	SlowLog LogWriter
+
+	// HealthCheckInterval 后台健康检查间隔，检查失败时自动Reconnect (可选)
+	// 0表示不启用
+	HealthCheckInterval time.Duration
+
+	// Warn 后台健康检查及重连失败时的日志写入 (可选)
+	Warn LogWriter
+
+	// Mode GetSession返回的session的一致性模式(读偏好) (可选)，nil表示驱动默认的Strong
+	// Strong/Primary: 读写都在主节点，数据最新但主节点负载最高；
+	// Monotonic: 写入前从节点读、写入后切换到主节点，同一session内的读不会倒退；
+	// Secondary/SecondaryPreferred/Nearest/Eventual: 从从节点读，可分担分析类查询的压力，
+	// 但可能读到复制延迟之前的旧数据，不适合写后立即读的场景
+	Mode *mgo.Mode
+}
+
+type LogWriter interface {
+	Println(format string, v ...interface{})
 }
 
 func DefaultConfig(addrs []string) *Config {
 	return &Config{
-		mgo.DialInfo{
+		DialInfo: mgo.DialInfo{
 			Addrs:    addrs,
 			Timeout:  10 * time.Second,
 			FailFast: true,
@@ -57,8 +133,19 @@ func DefaultConfig(addrs []string) *Config {
 }
 
 type mongoV1 struct {
-	conf        *Config
+	conf *Config
+
+	// rootSession Reconnect时整体替换，由mutex保护
+	mutex       sync.RWMutex
 	rootSession *mgo.Session
+
+	// 后台健康检查
+	stopC chan struct{}
+	wg    sync.WaitGroup
+
+	// session使用统计
+	activeSessions int64
+	totalSessions  int64
 }
 
 func newMongoV1() Interface {
@@ -66,29 +153,276 @@ func newMongoV1() Interface {
 }
 
 func (m *mongoV1) Open(conf *Config) (err error) {
-	m.rootSession, err = mgo.DialWithInfo(&conf.DialInfo)
+	m.conf = conf
+	m.rootSession, err = dial(conf)
 	if err != nil {
 		return err
 	}
-	if err = m.rootSession.Ping(); err != nil {
-		return err
+	if conf.HealthCheckInterval > 0 {
+		m.stopC = make(chan struct{})
+		m.wg.Add(1)
+		go m.healthCheck(conf.HealthCheckInterval)
 	}
-	return err
+	return nil
 }
 
 func (m *mongoV1) Close() error {
+	if m.stopC != nil {
+		close(m.stopC)
+		m.wg.Wait()
+		m.stopC = nil
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 	if m.rootSession != nil {
 		m.rootSession.Close()
+		m.rootSession = nil
 	}
 	return nil
 }
 
-func (m *mongoV1) GetSession() *mgo.Session {
-	return m.rootSession.Copy()
+// dial 连接Mongo并检查连接是否可用
+func dial(conf *Config) (*mgo.Session, error) {
+	s, err := mgo.DialWithInfo(&conf.DialInfo)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.Ping(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (m *mongoV1) Ping() error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.rootSession == nil {
+		return ErrNotOpened
+	}
+	return ping(m.rootSession)
+}
+
+// ping 对已关闭的session调用Ping会panic，此时转换为错误返回
+func ping(s *mgo.Session) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("mongo: ping failed, %v", r)
+		}
+	}()
+	// 刷新session以丢弃已断开的socket，否则Ping会一直复用失效的连接
+	s.Refresh()
+	return s.Ping()
+}
+
+func (m *mongoV1) Reconnect() error {
+	// rootSession仅在Open之前或Close之后为空
+	m.mutex.RLock()
+	opened := m.rootSession != nil
+	m.mutex.RUnlock()
+	if !opened {
+		return ErrNotOpened
+	}
+	if err := m.Ping(); err == nil {
+		return nil
+	}
+
+	s, err := dial(m.conf)
+	if err != nil {
+		return fmt.Errorf("mongo: reconnect failed, %v", err)
+	}
+
+	m.mutex.Lock()
+	if m.rootSession == nil {
+		// 重连期间被关闭
+		m.mutex.Unlock()
+		s.Close()
+		return ErrNotOpened
+	}
+	old := m.rootSession
+	m.rootSession = s
+	m.mutex.Unlock()
+
+	// 已经取得的session副本持有各自的socket，关闭根session不影响它们
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// healthCheck 定期检查连接，失败时重连
+func (m *mongoV1) healthCheck(interval time.Duration) {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stopC:
+			return
+		case <-ticker.C:
+		}
+		if err := m.Ping(); err == nil {
+			continue
+		} else if m.conf.Warn != nil {
+			m.conf.Warn.Println("Mongo health check failed, %v", err)
+		}
+		if err := m.Reconnect(); err != nil && m.conf.Warn != nil {
+			m.conf.Warn.Println("%v", err)
+		}
+	}
+}
+
+func (m *mongoV1) Find(db, collection string, query bson.M, result interface{}) error {
+	defer m.traceSlow("find", db, collection, query, time.Now())
+
+	s, err := m.GetSession()
+	if err != nil {
+		return err
+	}
+	defer m.PutSession(s)
+	return s.DB(db).C(collection).Find(query).All(result)
+}
+
+func (m *mongoV1) FindOne(db, collection string, query bson.M, result interface{}) error {
+	defer m.traceSlow("findOne", db, collection, query, time.Now())
+
+	s, err := m.GetSession()
+	if err != nil {
+		return err
+	}
+	defer m.PutSession(s)
+	return s.DB(db).C(collection).Find(query).One(result)
+}
+
+func (m *mongoV1) Insert(db, collection string, docs ...interface{}) error {
+	defer m.traceSlow("insert", db, collection, nil, time.Now())
+
+	s, err := m.GetSession()
+	if err != nil {
+		return err
+	}
+	defer m.PutSession(s)
+	return s.DB(db).C(collection).Insert(docs...)
+}
+
+func (m *mongoV1) Update(db, collection string, selector bson.M, update interface{}) error {
+	defer m.traceSlow("update", db, collection, selector, time.Now())
+
+	s, err := m.GetSession()
+	if err != nil {
+		return err
+	}
+	defer m.PutSession(s)
+	return s.DB(db).C(collection).Update(selector, update)
+}
+
+func (m *mongoV1) Remove(db, collection string, selector bson.M) error {
+	defer m.traceSlow("remove", db, collection, selector, time.Now())
+
+	s, err := m.GetSession()
+	if err != nil {
+		return err
+	}
+	defer m.PutSession(s)
+	return s.DB(db).C(collection).Remove(selector)
+}
+
+// traceSlow 记录耗时超过SlowThreshold的操作
+func (m *mongoV1) traceSlow(op, db, collection string, query bson.M, start time.Time) {
+	if m.conf == nil || m.conf.SlowLog == nil || m.conf.SlowThreshold <= 0 {
+		return
+	}
+	if cost := time.Since(start); cost >= m.conf.SlowThreshold {
+		m.conf.SlowLog.Println("Slow mongo %s on %s.%s cost %v, query: %s", op, db, collection, cost, redactQuery(query))
+	}
+}
+
+// redactQuery 生成查询条件的摘要，仅保留字段名与操作符，值统一替换为"?"
+func redactQuery(v interface{}) string {
+	switch t := v.(type) {
+	case bson.M:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		fields := make([]string, 0, len(keys))
+		for _, k := range keys {
+			fields = append(fields, fmt.Sprintf("%s:%s", k, redactQuery(t[k])))
+		}
+		return "{" + strings.Join(fields, ",") + "}"
+	case []bson.M:
+		items := make([]string, 0, len(t))
+		for _, item := range t {
+			items = append(items, redactQuery(item))
+		}
+		return "[" + strings.Join(items, ",") + "]"
+	case []interface{}:
+		items := make([]string, 0, len(t))
+		for _, item := range t {
+			items = append(items, redactQuery(item))
+		}
+		return "[" + strings.Join(items, ",") + "]"
+	case nil:
+		return "{}"
+	default:
+		return "?"
+	}
+}
+
+func (m *mongoV1) GetSession() (*mgo.Session, error) {
+	s, err := m.copySession()
+	if err != nil {
+		return nil, err
+	}
+	if m.conf != nil && m.conf.Mode != nil {
+		s.SetMode(*m.conf.Mode, true)
+	}
+	return s, nil
+}
+
+func (m *mongoV1) GetSessionWithMode(mode mgo.Mode) (*mgo.Session, error) {
+	s, err := m.copySession()
+	if err != nil {
+		return nil, err
+	}
+	s.SetMode(mode, true)
+	return s, nil
+}
+
+func (m *mongoV1) copySession() (*mgo.Session, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	if m.rootSession == nil {
+		return nil, ErrNotOpened
+	}
+	atomic.AddInt64(&m.activeSessions, 1)
+	atomic.AddInt64(&m.totalSessions, 1)
+	return m.rootSession.Copy(), nil
 }
 
 func (m *mongoV1) PutSession(s *mgo.Session) {
 	if s != nil {
 		s.Close()
+		atomic.AddInt64(&m.activeSessions, -1)
+	}
+}
+
+func (m *mongoV1) WithSession(fn func(s *mgo.Session) error) error {
+	s, err := m.GetSession()
+	if err != nil {
+		return err
+	}
+	defer m.PutSession(s)
+	return fn(s)
+}
+
+func (m *mongoV1) Stats() Stats {
+	return Stats{
+		Active: int(atomic.LoadInt64(&m.activeSessions)),
+		Total:  atomic.LoadInt64(&m.totalSessions),
 	}
 }
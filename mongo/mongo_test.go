@@ -0,0 +1,94 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mongo
+
+import (
+	"testing"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRedactQuery(t *testing.T) {
+	query := bson.M{
+		"zone": "bj",
+		"cpu":  bson.M{"$gt": 8},
+		"$or":  []interface{}{bson.M{"name": "web1"}, bson.M{"name": "web2"}},
+	}
+
+	expect := "{$or:[{name:?},{name:?}],cpu:{$gt:?},zone:?}"
+	if s := redactQuery(query); s != expect {
+		t.Fatalf("Redacted query %s != %s", s, expect)
+	}
+	if s := redactQuery(nil); s != "{}" {
+		t.Fatalf("Redacted nil query %s != {}", s)
+	}
+}
+
+func TestPingBeforeOpen(t *testing.T) {
+	m := New()
+	if err := m.Ping(); err == nil {
+		t.Fatal("Ping before open should fail")
+	}
+	if err := m.Reconnect(); err == nil {
+		t.Fatal("Reconnect before open should fail")
+	}
+}
+
+func TestNotOpened(t *testing.T) {
+	m := New()
+	if _, err := m.GetSession(); err != ErrNotOpened {
+		t.Fatalf("Expect ErrNotOpened before open, but got %v", err)
+	}
+	if _, err := m.GetSessionWithMode(mgo.Secondary); err != ErrNotOpened {
+		t.Fatalf("Expect ErrNotOpened before open, but got %v", err)
+	}
+	if err := m.WithSession(func(s *mgo.Session) error { return nil }); err != ErrNotOpened {
+		t.Fatalf("Expect ErrNotOpened before open, but got %v", err)
+	}
+	if err := m.FindOne("db", "c", bson.M{}, &bson.M{}); err != ErrNotOpened {
+		t.Fatalf("Expect ErrNotOpened before open, but got %v", err)
+	}
+
+	// 模拟Open之后Close，无需真实的Mongo
+	mv := m.(*mongoV1)
+	mv.rootSession = &mgo.Session{}
+	if err := m.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := m.GetSession(); err != ErrNotOpened {
+		t.Fatalf("Expect ErrNotOpened after close, but got %v", err)
+	}
+	if err := m.Reconnect(); err != ErrNotOpened {
+		t.Fatalf("Expect ErrNotOpened after close, but got %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	m := New()
+	m.GetSession()
+	m.PutSession(nil)
+	if st := m.Stats(); st.Active != 0 || st.Total != 0 {
+		t.Fatalf("Failed or nil sessions should not be counted, %+v", st)
+	}
+
+	// 释放一个session，活跃数减1
+	mv := m.(*mongoV1)
+	mv.activeSessions, mv.totalSessions = 1, 1
+	m.PutSession(&mgo.Session{})
+	if st := m.Stats(); st.Active != 0 || st.Total != 1 {
+		t.Fatalf("Unexpected stats %+v", st)
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqwrapper
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Hurricanezwf/rabbitmq-go/mq"
+)
+
+// ProducerBinding 生产者绑定，Exchange为空时使用默认交换机，此时RouteKey必须等于目标队列名
+type ProducerBinding struct {
+	// Name 绑定名，PostTo据此选择绑定，多个绑定时不能重复
+	Name string
+
+	Exchange     string
+	ExchangeKind string
+	Queue        string
+	RouteKey     string
+}
+
+// ConsumerBinding 消费者绑定，每个绑定的队列独立消费，消息统一由注册的处理器处理
+type ConsumerBinding struct {
+	Exchange     string
+	ExchangeKind string
+	Queue        string
+	RouteKey     string
+}
+
+// producerBindings 返回生产者绑定，未配置ProducerBindings时由ProducerXXX字段生成一个绑定
+func (c *Config) producerBindings() []ProducerBinding {
+	if len(c.ProducerBindings) > 0 {
+		return c.ProducerBindings
+	}
+	return []ProducerBinding{
+		{
+			Exchange:     c.ProducerExchange,
+			ExchangeKind: c.ProducerExchangeKind,
+			Queue:        c.ProducerQueue,
+			RouteKey:     c.ProducerRouteKey,
+		},
+	}
+}
+
+// consumerBindings 返回消费者绑定，未配置ConsumerBindings时由ConsumerXXX字段生成一个绑定
+func (c *Config) consumerBindings() []ConsumerBinding {
+	if len(c.ConsumerBindings) > 0 {
+		return c.ConsumerBindings
+	}
+	return []ConsumerBinding{
+		{
+			Exchange:     c.ConsumerExchange,
+			ExchangeKind: c.ConsumerExchangeKind,
+			Queue:        c.ConsumerQueue,
+			RouteKey:     c.ConsumerRouteKey,
+		},
+	}
+}
+
+func validateProducerConf(conf *Config) error {
+	if len(conf.ProducerBindings) <= 0 {
+		return validateProducerBinding(conf.producerBindings()[0], conf.ProducerDelayed)
+	}
+	if len(conf.ProducerExchange) > 0 || len(conf.ProducerQueue) > 0 || len(conf.ProducerRouteKey) > 0 {
+		return errors.New("'ProducerBindings' can not be set with 'ProducerExchange', 'ProducerQueue' or 'ProducerRouteKey'")
+	}
+	names := make(map[string]bool, len(conf.ProducerBindings))
+	for i, b := range conf.ProducerBindings {
+		if names[b.Name] {
+			return fmt.Errorf("Duplicate producer binding name '%s'", b.Name)
+		}
+		names[b.Name] = true
+		if err := validateProducerBinding(b, conf.ProducerDelayed); err != nil {
+			return fmt.Errorf("ProducerBindings[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func validateProducerBinding(b ProducerBinding, delayed bool) error {
+	if len(b.Exchange) <= 0 {
+		// 使用默认交换机, RouteKey即目标队列名
+		if delayed {
+			return errors.New("Missing 'ProducerExchange', default exchange can not be delayed")
+		}
+		if len(b.RouteKey) <= 0 {
+			return errors.New("Missing 'ProducerRouteKey', it must be the target queue name when 'ProducerExchange' is empty")
+		}
+		if len(b.Queue) > 0 && b.Queue != b.RouteKey {
+			return errors.New("'ProducerRouteKey' must equal 'ProducerQueue' when 'ProducerExchange' is empty")
+		}
+		return nil
+	}
+	if len(b.Queue) <= 0 {
+		return errors.New("Missing 'ProducerQueue'")
+	}
+	if len(b.RouteKey) <= 0 {
+		return errors.New("Missing 'ProdicerRoutekey'")
+	}
+	if len(b.ExchangeKind) <= 0 {
+		return errors.New("Missing 'ProducerExchangeKind'")
+	}
+	return nil
+}
+
+func validateConsumerConf(conf *Config) error {
+	if len(conf.ConsumerBindings) <= 0 {
+		return validateConsumerBinding(conf.consumerBindings()[0])
+	}
+	if len(conf.ConsumerExchange) > 0 || len(conf.ConsumerQueue) > 0 || len(conf.ConsumerRouteKey) > 0 {
+		return errors.New("'ConsumerBindings' can not be set with 'ConsumerExchange', 'ConsumerQueue' or 'ConsumerRouteKey'")
+	}
+	for i, b := range conf.ConsumerBindings {
+		if err := validateConsumerBinding(b); err != nil {
+			return fmt.Errorf("ConsumerBindings[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func validateConsumerBinding(b ConsumerBinding) error {
+	if len(b.Exchange) <= 0 {
+		return errors.New("Missin 'ConsumerExchange'")
+	}
+	if len(b.Queue) <= 0 {
+		return errors.New("Missing 'ConsumerQueue'")
+	}
+	if len(b.RouteKey) <= 0 {
+		return errors.New("Missing 'ConsumerRouteKey'")
+	}
+	if len(b.ExchangeKind) <= 0 {
+		return errors.New("Missing 'ConsumerExchangeKind'")
+	}
+	return nil
+}
+
+// producerExchangeBinds 生成生产者需要声明的交换机绑定，使用默认交换机的绑定无需声明
+func producerExchangeBinds(conf *Config) []*mq.ExchangeBinds {
+	var exbs []*mq.ExchangeBinds
+	for _, b := range conf.producerBindings() {
+		if len(b.Exchange) <= 0 {
+			continue
+		}
+		exb := &mq.ExchangeBinds{
+			Exch: mq.DefaultExchange(b.Exchange, b.ExchangeKind),
+			Bindings: []*mq.Binding{
+				{
+					RouteKey: b.RouteKey,
+					Queues: []*mq.Queue{
+						mq.DefaultQueue(b.Queue),
+					},
+				},
+			},
+		}
+		if conf.ProducerDelayed {
+			exb.Exch.Kind = delayedExchangeKind
+			exb.Exch.Args = mq.Table{"x-delayed-type": b.ExchangeKind}
+		}
+		exbs = append(exbs, exb)
+	}
+	return exbs
+}
+
+// consumerExchangeBinds 生成消费者的交换机绑定，每个消费者绑定对应一个元素
+func consumerExchangeBinds(conf *Config) []*mq.ExchangeBinds {
+	var exbs []*mq.ExchangeBinds
+	for _, b := range conf.consumerBindings() {
+		exbs = append(exbs, &mq.ExchangeBinds{
+			Exch: mq.DefaultExchange(b.Exchange, b.ExchangeKind),
+			Bindings: []*mq.Binding{
+				{
+					RouteKey: b.RouteKey,
+					Queues: []*mq.Queue{
+						mq.DefaultQueue(b.Queue),
+					},
+				},
+			},
+		})
+	}
+	return exbs
+}
+
+// consumerName 返回第i个消费者绑定的消费者名，消费者名同时作为其收到消息的ConsumerTag
+func consumerName(i int) string {
+	if i == 0 {
+		return "ConsumeFrom"
+	}
+	return fmt.Sprintf("ConsumeFrom%d", i)
+}
+
+// consumerQueue 根据消息的ConsumerTag查找消费该消息的队列
+// 所有绑定共用同一个接收通道，多个绑定时只能据此区分消息来自哪个队列
+func (w *MQWrapper) consumerQueue(d mq.Delivery) (string, error) {
+	bindings := w.conf.consumerBindings()
+	for i, b := range bindings {
+		if d.ConsumerTag == consumerName(i) {
+			return b.Queue, nil
+		}
+	}
+	if len(bindings) == 1 {
+		return bindings[0].Queue, nil
+	}
+	return "", fmt.Errorf("Unknown consumer tag '%s'", d.ConsumerTag)
+}
+
+// findProducerBinding 按名称查找生产者绑定，name为空时返回第一个绑定
+func (w *MQWrapper) findProducerBinding(name string) (ProducerBinding, error) {
+	bindings := w.conf.producerBindings()
+	if len(name) <= 0 {
+		return bindings[0], nil
+	}
+	for _, b := range bindings {
+		if b.Name == name {
+			return b, nil
+		}
+	}
+	return ProducerBinding{}, fmt.Errorf("Unknown producer binding '%s'", name)
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqwrapper
+
+import (
+	"sync"
+	"time"
+)
+
+// panicBreaker 按actionKey统计处理器panic次数的熔断器
+// 在window时间内panic达到budget次后熔断，cooldown之后自动恢复
+type panicBreaker struct {
+	mutex sync.Mutex
+
+	budget   int
+	window   time.Duration
+	cooldown time.Duration
+
+	states map[int32]*breakerState
+}
+
+type breakerState struct {
+	// 窗口内的panic时间点
+	panics []time.Time
+
+	// 熔断截止时间
+	openUntil time.Time
+}
+
+func newPanicBreaker(budget int, window, cooldown time.Duration) *panicBreaker {
+	if window <= 0 {
+		window = time.Minute
+	}
+	if cooldown <= 0 {
+		cooldown = time.Minute
+	}
+	return &panicBreaker{
+		budget:   budget,
+		window:   window,
+		cooldown: cooldown,
+		states:   make(map[int32]*breakerState),
+	}
+}
+
+// allow 判断actionKey当前是否允许分发
+func (b *panicBreaker) allow(actionKey int32) bool {
+	if b == nil || b.budget <= 0 {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s, exist := b.states[actionKey]
+	if !exist {
+		return true
+	}
+	return time.Now().After(s.openUntil)
+}
+
+// openUntil 返回actionKey熔断的截止时间，未熔断时返回零值
+func (b *panicBreaker) openUntil(actionKey int32) time.Time {
+	if b == nil || b.budget <= 0 {
+		return time.Time{}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if s, exist := b.states[actionKey]; exist {
+		return s.openUntil
+	}
+	return time.Time{}
+}
+
+// recordPanic 记录一次panic，返回是否因此触发熔断
+func (b *panicBreaker) recordPanic(actionKey int32) bool {
+	if b == nil || b.budget <= 0 {
+		return false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	s, exist := b.states[actionKey]
+	if !exist {
+		s = &breakerState{}
+		b.states[actionKey] = s
+	}
+
+	now := time.Now()
+	valid := s.panics[:0]
+	for _, t := range s.panics {
+		if now.Sub(t) < b.window {
+			valid = append(valid, t)
+		}
+	}
+	s.panics = append(valid, now)
+
+	if len(s.panics) >= b.budget {
+		s.panics = s.panics[:0]
+		s.openUntil = now.Add(b.cooldown)
+		return true
+	}
+	return false
+}
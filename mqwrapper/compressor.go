@@ -0,0 +1,135 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqwrapper
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// 压缩算法编号，写入编码选项的bit3~bit4，解码时据此选择算法
+const (
+	CodecGzip   uint8 = 0
+	CodecSnappy uint8 = 1
+	CodecZstd   uint8 = 2
+)
+
+// Compressor 消息体压缩算法，可通过TunableEncoder.SetCompressor替换默认的gzip
+type Compressor interface {
+	// Codec 返回压缩算法编号，必须是CodecGzip、CodecSnappy或CodecZstd之一，
+	// 解码时按编号选择内置的算法
+	Codec() uint8
+	Compress(data []byte) ([]byte, error)
+	Decompress(compressed []byte) ([]byte, error)
+}
+
+// NewGzipCompressor 返回指定级别(1~9)的gzip压缩算法
+func NewGzipCompressor(level int) Compressor {
+	return &gzipCompressor{level: level}
+}
+
+// NewSnappyCompressor 返回snappy压缩算法，压缩率低于gzip但速度快得多，适合对延迟敏感的场景
+func NewSnappyCompressor() Compressor {
+	return snappyCompressor{}
+}
+
+// NewZstdCompressor 返回zstd压缩算法，压缩率与gzip相当而速度更快
+func NewZstdCompressor() Compressor {
+	return &zstdCompressor{}
+}
+
+// builtinCompressors 解码时可用的压缩算法
+var builtinCompressors = map[uint8]Compressor{
+	CodecGzip:   NewGzipCompressor(defaultCompressLevel),
+	CodecSnappy: NewSnappyCompressor(),
+	CodecZstd:   NewZstdCompressor(),
+}
+
+type gzipCompressor struct {
+	level int
+}
+
+func (c *gzipCompressor) Codec() uint8 { return CodecGzip }
+
+func (c *gzipCompressor) Compress(data []byte) ([]byte, error) {
+	return compress(data, c.level)
+}
+
+func (c *gzipCompressor) Decompress(compressed []byte) ([]byte, error) {
+	return Decompress(compressed)
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Codec() uint8 { return CodecSnappy }
+
+func (snappyCompressor) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCompressor) Decompress(compressed []byte) ([]byte, error) {
+	return snappy.Decode(nil, compressed)
+}
+
+// zstdCompressor 编解码器在首次使用时创建，EncodeAll/DecodeAll可并发调用
+type zstdCompressor struct {
+	once sync.Once
+	enc  *zstd.Encoder
+	dec  *zstd.Decoder
+	err  error
+}
+
+func (c *zstdCompressor) init() error {
+	c.once.Do(func() {
+		if c.enc, c.err = zstd.NewWriter(nil); c.err != nil {
+			return
+		}
+		c.dec, c.err = zstd.NewReader(nil)
+	})
+	return c.err
+}
+
+func (c *zstdCompressor) Codec() uint8 { return CodecZstd }
+
+func (c *zstdCompressor) Compress(data []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.enc.EncodeAll(data, nil), nil
+}
+
+func (c *zstdCompressor) Decompress(compressed []byte) ([]byte, error) {
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+	return c.dec.DecodeAll(compressed, nil)
+}
+
+// codecName 返回压缩算法编号对应的名称，用于Describe
+func codecName(codec uint8) string {
+	switch codec {
+	case CodecGzip:
+		return "gzip"
+	case CodecSnappy:
+		return "snappy"
+	case CodecZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("codec %d", codec)
+	}
+}
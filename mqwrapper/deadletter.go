@@ -0,0 +1,62 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqwrapper
+
+import "github.com/Hurricanezwf/rabbitmq-go/mq"
+
+// HeaderRetryCount 记录消息处理失败次数的消息头
+const HeaderRetryCount = "x-retry-count"
+
+// retryOrDeadLetter 将处理失败的消息经默认交换机重新投递到消费该消息的队列，
+// 失败次数达到MaxRetries后投递到DeadLetterExchange
+// 不投递到来源交换机，否则fanout、topic交换机会将消息复制到其它绑定的队列
+func (w *MQWrapper) retryOrDeadLetter(d mq.Delivery) error {
+	var failures int32
+	if v, ok := d.Headers[HeaderRetryCount]; ok {
+		// 消息头无法解析时从0开始计数
+		failures, _ = parseInt32Header(HeaderRetryCount, v)
+	}
+	failures++
+
+	// 保留原有消息头，裸编码模式下ActionKey等元数据都在其中
+	headers := make(mq.Table, len(d.Headers)+1)
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[HeaderRetryCount] = failures
+
+	msg := mq.NewPublishMsg(d.Body)
+	msg.ContentType = d.ContentType
+	msg.Headers = headers
+
+	var exchange, routeKey string
+	if int(failures) < w.conf.MaxRetries {
+		queue, err := w.consumerQueue(d)
+		if err != nil {
+			return err
+		}
+		exchange, routeKey = "", queue
+	} else {
+		exchange, routeKey = w.conf.DeadLetterExchange, w.conf.DeadLetterRouteKey
+		if w.conf.Warn != nil {
+			w.conf.Warn.Println("%s: Msg failed %d times, publish to dead letter exchange '%s'", w.id, failures, exchange)
+		}
+	}
+
+	w.connMu.RLock()
+	p := w.retryProducer
+	w.connMu.RUnlock()
+	return p.Publish(exchange, routeKey, msg)
+}
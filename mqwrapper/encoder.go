@@ -17,10 +17,17 @@ package mqwrapper
 import (
 	"bytes"
 	"compress/gzip"
+	"compress/zlib"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
+	"strings"
+
+	"github.com/Hurricanezwf/pkg/cryptolib"
+	"github.com/Hurricanezwf/pkg/internal/gziputil"
 )
 
 type MsgEncoder interface {
@@ -28,50 +35,183 @@ type MsgEncoder interface {
 	Decode(b []byte) (actionKey int32, msgBody []byte, err error)
 }
 
+// MsgEncoderCloser 持有资源(如池化的压缩器、字典)的编码器可实现该接口，
+// MQWrapper.Close时将调用其Close释放资源，无状态的编码器无需实现
+type MsgEncoderCloser interface {
+	MsgEncoder
+	Close() error
+}
+
+// TunableEncoder 可调整压缩参数的编码器
+type TunableEncoder interface {
+	MsgEncoder
+
+	// SetCompressionThreshold 设置压缩阈值，超过该长度的消息体将被压缩，<0按0处理
+	SetCompressionThreshold(n int)
+
+	// SetCompressionLevel 设置gzip压缩级别(1~9)，默认为5
+	SetCompressionLevel(level int) error
+
+	// SetCompressor 设置编码时使用的压缩算法，默认为gzip。
+	// 解码时按编码选项选择算法，内置的gzip、snappy、zstd总是可用
+	SetCompressor(c Compressor) error
+
+	// SetEncryption 设置加密密钥及算法(见cryptolib)，消息体在压缩之后加密，key为空表示不加密。
+	// 未加密的消息总是可以解码，加密的消息需要解码端配置相同的密钥
+	SetEncryption(key []byte, encType byte) error
+}
+
 func DefaultEncoder() MsgEncoder {
 	return newMsgEncoderV1()
 }
 
+// NewTunableEncoder 返回默认格式的编码器，可调整压缩阈值及级别后通过MQWrapper.SetEncoder使用
+// 压缩参数只影响编码，解码端无需相同的配置
+func NewTunableEncoder() TunableEncoder {
+	return newMsgEncoderV1().(*msgEncoderV1)
+}
+
 type msgEncoderV1 struct {
 	// 消息魔数
 	magicN byte
 
 	// 最大报文段长度
 	maxSegmentLen uint32
+
+	// 超过该长度的消息体将被压缩
+	compressThreshold int
+
+	// gzip压缩级别
+	compressLevel int
+
+	// 压缩算法，nil表示以compressLevel进行gzip压缩
+	compressor Compressor
+
+	// 预置压缩字典，非空时使用zlib+字典压缩
+	dict []byte
+
+	// 加密密钥及算法，密钥为空表示不加密
+	cryptKey  []byte
+	cryptType byte
 }
 
 func newMsgEncoderV1() MsgEncoder {
 	return &msgEncoderV1{
-		magicN:        0x22,
-		maxSegmentLen: 5242880, // 默认限制5MB
+		magicN:            0x22,
+		maxSegmentLen:     5242880, // 默认限制5MB
+		compressThreshold: 51200,   // 默认超过50KB压缩
+		compressLevel:     defaultCompressLevel,
 	}
 }
 
+func (e *msgEncoderV1) SetCompressionThreshold(n int) {
+	if n < 0 {
+		n = 0
+	}
+	e.compressThreshold = n
+}
+
+// SetCompressionLevel 设置gzip压缩级别，使用预置字典时固定为最高级别，不受该设置影响
+func (e *msgEncoderV1) SetCompressionLevel(level int) error {
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		return fmt.Errorf("Bad compression level %d, it should be in [1, 9]", level)
+	}
+	e.compressLevel = level
+	return nil
+}
+
+// SetCompressor 设置压缩算法，nil表示恢复默认的gzip。使用预置字典时固定使用zlib，不受该设置影响
+// Codec必须是内置的压缩算法编号，否则解码方无法解压
+func (e *msgEncoderV1) SetCompressor(c Compressor) error {
+	if c != nil {
+		if _, ok := builtinCompressors[c.Codec()]; !ok {
+			return fmt.Errorf("Unsupported compressor codec %d", c.Codec())
+		}
+	}
+	e.compressor = c
+	return nil
+}
+
+// SetEncryption 设置加密密钥及算法，会先尝试加密一次以尽早发现不支持的算法
+func (e *msgEncoderV1) SetEncryption(key []byte, encType byte) error {
+	if len(key) <= 0 {
+		e.cryptKey = nil
+		return nil
+	}
+	if _, err := cryptolib.Encrypt(key, []byte{}, encType); err != nil {
+		return fmt.Errorf("Bad encryption config, %v", err)
+	}
+	e.cryptKey = append([]byte(nil), key...)
+	e.cryptType = encType
+	return nil
+}
+
+// NewDictEncoder 返回使用预置字典压缩的编码器
+// 字典对结构相似的小消息有明显的压缩效果，因此所有消息体都会尝试压缩，
+// 仅在压缩后更短时才使用压缩结果。解码端必须使用相同的字典
+func NewDictEncoder(dict []byte) MsgEncoder {
+	e := newMsgEncoderV1().(*msgEncoderV1)
+	if len(dict) > 0 {
+		e.dict = append([]byte(nil), dict...)
+		e.compressThreshold = 0
+	}
+	return e
+}
+
 // Encode 编码MQ消息
 // 1 Byte : 魔数
 // 3 Bytes: 编码选项
 // 4 Bytes: ActionKey
 // 4 Bytes: MsgBodyLen
 // N Bytes: MsgBody
+// 4 Bytes: MsgBody的CRC32(IEEE)，仅在bit2为1时存在
 //
 // 编码选项(从左至右分别为bit0~bit24)：
 // bit0表示msgBody是否压缩，1表示压缩，0表示不压缩
-// bit1~bit23暂时预留
+// bit1表示压缩时是否使用了预置字典(zlib)，1表示使用，0表示使用bit3~bit4指定的算法
+// bit2表示是否携带校验和，校验的是帧中(压缩后)的msgBody。旧版本解码时会忽略末尾的校验和
+// bit3~bit4表示压缩算法编号，0为gzip，1为snappy，2为zstd，见Compressor
+// bit5表示msgBody是否加密(cryptolib信封格式)，加密在压缩之后进行
+// bit6~bit23暂时预留，必须为0，解码时遇到无法识别的选项将返回错误
 //
 func (e *msgEncoderV1) Encode(actionKey int32, msgBody []byte) ([]byte, error) {
-	// 超过50KB的消息体，将进行gzip压缩，压缩级别为5
-	var err error
+	// 超过阈值(默认50KB)的消息体，将进行压缩
 	var isCompressed bool
-	if len(msgBody) > 51200 {
-		msgBody, err = Compress(msgBody)
+	var withDict bool
+	var codec uint8
+	if len(msgBody) > e.compressThreshold {
+		var compressed []byte
+		var err error
+		if len(e.dict) > 0 {
+			compressed, err = CompressWithDict(msgBody, e.dict)
+		} else if e.compressor != nil {
+			codec = e.compressor.Codec()
+			compressed, err = e.compressor.Compress(msgBody)
+		} else {
+			compressed, err = compress(msgBody, e.compressLevel)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("Compress msg body failed, %v", err)
 		}
-		isCompressed = true
+		if len(e.dict) <= 0 || len(compressed) < len(msgBody) {
+			msgBody = compressed
+			isCompressed = true
+			withDict = len(e.dict) > 0
+		}
+	}
+
+	// 加密
+	isEncrypted := len(e.cryptKey) > 0
+	if isEncrypted {
+		encrypted, err := cryptolib.Encrypt(e.cryptKey, msgBody, e.cryptType)
+		if err != nil {
+			return nil, fmt.Errorf("Encrypt msg body failed, %v", err)
+		}
+		msgBody = encrypted
 	}
 
 	// 消息长度限制
-	segmentLen := 1 + 3 + 4 + 4 + len(msgBody)
+	segmentLen := 1 + 3 + 4 + 4 + len(msgBody) + 4
 	if uint32(segmentLen) > e.maxSegmentLen {
 		return nil, errors.New("msg too long")
 	}
@@ -85,8 +225,17 @@ func (e *msgEncoderV1) Encode(actionKey int32, msgBody []byte) ([]byte, error) {
 	// Header Option
 	offset++
 	if isCompressed {
-		buf[offset] = 0x80
+		buf[offset] |= 0x80
+	}
+	if withDict {
+		buf[offset] |= 0x40
+	} else if isCompressed {
+		buf[offset] |= codec << optionCodecShift
 	}
+	if isEncrypted {
+		buf[offset] |= optionEncrypted
+	}
+	buf[offset] |= optionChecksum
 
 	// ActionKey
 	offset += 3
@@ -100,6 +249,10 @@ func (e *msgEncoderV1) Encode(actionKey int32, msgBody []byte) ([]byte, error) {
 	offset += 4
 	copy(buf[offset:offset+len(msgBody)], msgBody)
 
+	// Checksum
+	offset += len(msgBody)
+	binary.BigEndian.PutUint32(buf[offset:offset+4], crc32.ChecksumIEEE(msgBody))
+
 	return buf, nil
 }
 
@@ -117,6 +270,8 @@ func (e *msgEncoderV1) Decode(b []byte) (action int32, msgBody []byte, err error
 
 	var offset uint32 = 0
 	var isCompressed bool
+	var withDict bool
+	var withChecksum bool
 
 	// 验证魔数
 	if b[0] != e.magicN {
@@ -124,10 +279,20 @@ func (e *msgEncoderV1) Decode(b []byte) (action int32, msgBody []byte, err error
 		return
 	}
 
-	// 获取头部选项
+	// 获取头部选项，存在无法识别的选项时拒绝解码，避免按错误的格式解析新版本的报文
+	if b[1]&^optionKnownMask != 0 || b[2] != 0 || b[3] != 0 {
+		err = fmt.Errorf("bad msg format, unknown option bits %02x %02x %02x", b[1]&^optionKnownMask, b[2], b[3])
+		return
+	}
 	if b[1]&0x80 > 0 {
 		isCompressed = true
 	}
+	if b[1]&0x40 > 0 {
+		withDict = true
+	}
+	if b[1]&optionChecksum > 0 {
+		withChecksum = true
+	}
 
 	// 解析ActionKey
 	offset = 4
@@ -146,9 +311,50 @@ func (e *msgEncoderV1) Decode(b []byte) (action int32, msgBody []byte, err error
 	}
 	msgBody = b[offset:bodyEnd]
 
+	// 校验
+	if withChecksum {
+		if bodyEnd+4 > uint32(len(b)) {
+			err = errors.New("msg too short")
+			return
+		}
+		if binary.BigEndian.Uint32(b[bodyEnd:bodyEnd+4]) != crc32.ChecksumIEEE(msgBody) {
+			err = errors.New("checksum mismatch")
+			return
+		}
+	}
+
+	// 解密
+	if b[1]&optionEncrypted > 0 {
+		if len(e.cryptKey) <= 0 {
+			err = errors.New("msg is encrypted, but no key configured")
+			return
+		}
+		msgBody, err = cryptolib.Decrypt(e.cryptKey, msgBody)
+		if err != nil {
+			err = fmt.Errorf("Decrypt msg body failed, %v", err)
+			return
+		}
+	}
+
 	// 解压缩
-	if isCompressed {
-		msgBody, err = Decompress(msgBody)
+	if isCompressed && withDict {
+		if len(e.dict) <= 0 {
+			err = errors.New("msg is compressed with dictionary, but no dictionary configured")
+			return
+		}
+		msgBody, err = DecompressWithDict(msgBody, e.dict)
+		if err != nil {
+			err = fmt.Errorf("Decompress msg body failed, %v", err)
+			return
+		}
+	} else if isCompressed {
+		codec := (b[1] & optionCodecMask) >> optionCodecShift
+		c, ok := builtinCompressors[codec]
+		if !ok {
+			err = fmt.Errorf("Unsupported compression codec %d", codec)
+			return
+		}
+		msgBody, err = c.Decompress(msgBody)
 		if err != nil {
 			err = fmt.Errorf("Decompress msg body failed, %v", err)
 			return
@@ -158,24 +364,130 @@ func (e *msgEncoderV1) Decode(b []byte) (action int32, msgBody []byte, err error
 	return action, msgBody, nil
 }
 
+// optionChecksum 编码选项中表示携带校验和的位(bit2)
+const optionChecksum = 0x20
+
+// 编码选项中表示压缩算法编号的位(bit3~bit4)
+const (
+	optionCodecMask  = 0x18
+	optionCodecShift = 3
+)
+
+// optionEncrypted 编码选项中表示消息体已加密的位(bit5)
+const optionEncrypted = 0x04
+
+// optionKnownMask 当前版本可识别的编码选项位(bit0~bit5)
+const optionKnownMask = 0x80 | 0x40 | optionChecksum | optionCodecMask | optionEncrypted
+
+// defaultCompressLevel 默认的gzip压缩级别
+const defaultCompressLevel = 5
+
+// Compress 使用gzip压缩，输出是确定性的：相同的输入总是得到相同的字节
+// gzip.Writer的Header为零值时，头部的修改时间为0、操作系统字段为255(unknown)，且不写入文件名和注释
 func Compress(data []byte) ([]byte, error) {
+	return compress(data, defaultCompressLevel)
+}
+
+// compress 以指定级别进行gzip压缩，见Compress
+func compress(data []byte, level int) ([]byte, error) {
+	return gziputil.Compress(data, level)
+}
+
+func Decompress(compressed []byte) ([]byte, error) {
+	return gziputil.Decompress(compressed)
+}
+
+// CompressWithDict 使用预置字典进行zlib压缩
+// zlib头部会记录字典的校验和，解压时字典不匹配将返回zlib.ErrDictionary。
+// 较低的压缩级别对字典的利用很差，而字典主要用于小消息，因此固定使用最高压缩级别
+func CompressWithDict(data, dict []byte) ([]byte, error) {
 	b := bytes.NewBuffer(nil)
-	w, err := gzip.NewWriterLevel(b, 5)
+	w, err := zlib.NewWriterLevelDict(b, zlib.BestCompression, dict)
 	if err != nil {
 		return nil, err
 	}
 	if _, err = w.Write(data); err != nil {
 		return nil, err
 	}
-	w.Close() // 这里的close不作为资源清理，而是将缓存中的数据刷入bytes.Buffer
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
 	return b.Bytes(), nil
 }
 
-func Decompress(compressed []byte) ([]byte, error) {
-	r, err := gzip.NewReader(bytes.NewBuffer(compressed))
+func DecompressWithDict(compressed, dict []byte) ([]byte, error) {
+	r, err := zlib.NewReaderDict(bytes.NewBuffer(compressed), dict)
 	if err != nil {
 		return nil, err
 	}
 	defer r.Close()
 	return ioutil.ReadAll(r)
 }
+
+// describePreviewLen Describe中消息体十六进制预览的最大字节数
+const describePreviewLen = 32
+
+// Describe 以可读的形式输出默认编码格式(见msgEncoderV1.Encode)的报文结构，用于排查编解码问题
+// 包括魔数、编码选项、ActionKey、消息体长度、压缩标志以及消息体的十六进制预览，不会解压消息体。
+// 报文不完整时返回已解析的部分及错误
+func Describe(b []byte) (string, error) {
+	var sb strings.Builder
+	if len(b) < 12 {
+		fmt.Fprintf(&sb, "total:      %d bytes\n", len(b))
+		return sb.String(), errors.New("msg too short")
+	}
+
+	var err error
+	magicN := b[0]
+	fmt.Fprintf(&sb, "magic:      0x%02x", magicN)
+	if magicN != newMsgEncoderV1().(*msgEncoderV1).magicN {
+		sb.WriteString(" (mismatch)")
+		err = errors.New("bad msg format, magicN didn't match")
+	}
+	sb.WriteString("\n")
+
+	compressed := b[1]&0x80 > 0
+	withDict := b[1]&0x40 > 0
+	fmt.Fprintf(&sb, "options:    %02x %02x %02x", b[1], b[2], b[3])
+	switch {
+	case compressed && withDict:
+		sb.WriteString(" (compressed, zlib with dictionary)")
+	case compressed:
+		fmt.Fprintf(&sb, " (compressed, %s)", codecName((b[1]&optionCodecMask)>>optionCodecShift))
+	}
+	if b[1]&optionEncrypted > 0 {
+		sb.WriteString(" (encrypted)")
+	}
+	if b[1]&optionChecksum > 0 {
+		sb.WriteString(" (crc32)")
+	}
+	sb.WriteString("\n")
+
+	actionKey := int32(binary.BigEndian.Uint32(b[4:8]))
+	bodyLen := binary.BigEndian.Uint32(b[8:12])
+	fmt.Fprintf(&sb, "actionKey:  %d\n", actionKey)
+	fmt.Fprintf(&sb, "bodyLen:    %d (total %d bytes)\n", bodyLen, len(b))
+	fmt.Fprintf(&sb, "compressed: %t\n", compressed)
+
+	body := b[12:]
+	if uint32(len(body)) < bodyLen {
+		if err == nil {
+			err = errors.New("msg too short")
+		}
+	} else {
+		if b[1]&optionChecksum > 0 && uint32(len(body)) >= bodyLen+4 {
+			fmt.Fprintf(&sb, "checksum:   %08x\n", binary.BigEndian.Uint32(body[bodyLen:bodyLen+4]))
+		}
+		body = body[:bodyLen]
+	}
+	preview := body
+	if len(preview) > describePreviewLen {
+		preview = preview[:describePreviewLen]
+	}
+	fmt.Fprintf(&sb, "body:       %s", hex.EncodeToString(preview))
+	if len(preview) < len(body) {
+		fmt.Fprintf(&sb, "... (%d more bytes)", len(body)-len(preview))
+	}
+	sb.WriteString("\n")
+	return sb.String(), err
+}
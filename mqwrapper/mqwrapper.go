@@ -15,13 +15,43 @@
 package mqwrapper
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Hurricanezwf/pkg/cryptolib"
 	"github.com/Hurricanezwf/rabbitmq-go/mq"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/any"
 )
 
+// ErrPublishTimeout 发布消息超时
+var ErrPublishTimeout = errors.New("publish timeout")
+
+// ErrPublishNack 发布确认模式下消息被broker拒绝
+var ErrPublishNack = errors.New("publish nacked by broker")
+
+// defaultConfirmTimeout 发布确认模式下未设置PublishTimeout时等待确认的时间
+const defaultConfirmTimeout = 5 * time.Second
+
+// defaultMaxConcurrency 默认同时处理消息的最大数目
+const defaultMaxConcurrency = 16
+
+// defaultCloseTimeout 默认的Close等待时间
+const defaultCloseTimeout = 30 * time.Second
+
+// delayedExchangeKind 延迟交换机类型，由rabbitmq_delayed_message_exchange插件提供
+const delayedExchangeKind = "x-delayed-message"
+
 type Config struct {
 	// Ready 协调各组件之间的状态，当一切就绪之后，Ready将可读，此时该组件开始对外释放能力
 	Ready <-chan struct{}
@@ -29,12 +59,30 @@ type Config struct {
 	MQUrl string
 
 	// 生产者配置
+	// ProducerExchange为空时表示使用默认交换机，此时直接投递到队列，
+	// ProducerRouteKey必须等于目标队列名，且不会声明交换机
 	EnableProducer       bool
 	ProducerExchange     string
 	ProducerExchangeKind string
 	ProducerQueue        string
 	ProducerRouteKey     string
 
+	// ProducerBindings 多个生产者绑定，与ProducerExchange等单一字段互斥
+	// 未设置时由单一字段生成一个绑定，Post投递到第一个绑定，PostTo可按名称选择
+	ProducerBindings []ProducerBinding
+
+	// ProducerDelayed 将生产者交换机声明为x-delayed-message类型，以支持PostDelayed
+	// 依赖RabbitMQ的rabbitmq_delayed_message_exchange插件，ProducerExchangeKind作为实际的路由类型
+	ProducerDelayed bool
+
+	// PublishTimeout 单次发布的超时时间，<=0表示不限制
+	// broker触发流控时发布可能一直阻塞，超时后本次尝试以ErrPublishTimeout失败并进入重试
+	PublishTimeout time.Duration
+
+	// ConfirmMode 开启发布确认，Post在broker确认(ack)后才返回成功，被拒绝(nack)时重试
+	// 等待确认的时间受PublishTimeout限制，未设置时为5秒
+	ConfirmMode bool
+
 	// 消费者配置
 	EnableConsumer       bool
 	ConsumerExchange     string
@@ -42,11 +90,81 @@ type Config struct {
 	ConsumerQueue        string
 	ConsumerRouteKey     string
 
+	// ConsumerBindings 多个消费者绑定，与ConsumerExchange等单一字段互斥
+	// 未设置时由单一字段生成一个绑定，每个绑定使用独立的消费者，预取数分别为MaxConcurrency
+	ConsumerBindings []ConsumerBinding
+
+	// RequeueOnClose 关闭时停止拉取新消息，并将已拉取但尚未开始处理的消息
+	// 显式Nack并重新入队，保证关闭期间消息不丢失也不会被静默Ack
+	RequeueOnClose bool
+
+	// CloseTimeout Close时等待正在处理的消息完成的最长时间，<=0时使用默认值30秒
+	// 超时后不再等待，直接关闭连接，未完成的消息将由broker重新投递
+	CloseTimeout time.Duration
+
+	// MaxConcurrency 同时处理消息的最大数目，<=0时使用默认值16
+	// 消费者的预取数(Qos)与之保持一致，避免拉取超出处理能力的消息
+	MaxConcurrency int
+
 	// 日志写入，如果为空将不记录日志
 	Debug LogWriter
 	Info  LogWriter
 	Warn  LogWriter
 	Error LogWriter
+
+	// ErrorSink 处理器错误上报通道 (可选)
+	// 消息处理失败时将以非阻塞的方式投递HandlerError，通道满时丢弃并计数，
+	// 丢弃数目可通过DroppedHandlerErrors获取
+	ErrorSink chan<- HandlerError
+
+	// 处理器panic熔断配置 (可选)
+	// 同一actionKey的处理器在PanicWindow(默认1分钟)内panic达到PanicBudget次后，
+	// 将停止分发该actionKey的消息，PanicCooldown(默认1分钟)之后自动恢复。PanicBudget<=0表示不启用。
+	// 熔断期间的消息按处理失败对待：启用死信(MaxRetries>0)时重新投递或进入DeadLetterExchange；
+	// 否则持有消息直至熔断结束再Nack并重新入队，避免broker立即重新投递造成空转，
+	// 持有期间占用并发名额，熔断的消息较多时其它消息的处理也会被推迟
+	PanicBudget   int
+	PanicWindow   time.Duration
+	PanicCooldown time.Duration
+
+	// ManualAck 处理器返回错误(包括panic)时Nack并重新入队，而不是直接Ack (可选)
+	// 仅由RegistActionHandler注册的处理器决定，观察者的错误只记录不影响确认；
+	// 解码失败或找不到处理器的消息仍会被Ack，避免无限重投
+	ManualAck bool
+
+	// 死信配置 (可选)
+	// MaxRetries>0时启用：处理器返回错误后，消息携带x-retry-count消息头经默认交换机
+	// 重新投递到消费该消息的队列，失败次数达到MaxRetries后投递到DeadLetterExchange，
+	// 两种情况下原消息均被Ack。启用后优先于ManualAck的重新入队
+	DeadLetterExchange string
+	DeadLetterRouteKey string
+	MaxRetries         int
+
+	// 断线重连配置 (可选)
+	// 连接断开后等待ReconnectInterval(默认1秒)重连，每次失败等待时间翻倍，
+	// 最长不超过MaxReconnectInterval(默认30秒)，直至重连成功或Close
+	ReconnectInterval    time.Duration
+	MaxReconnectInterval time.Duration
+
+	// 消息加密配置 (可选)
+	// EncryptKey非空时，投递的消息体使用EncryptType(默认cryptolib.TypeAES256GCM)加密，
+	// 接收时自动解密，未加密的消息仍可正常处理。编码器需实现TunableEncoder
+	EncryptKey  []byte
+	EncryptType byte
+}
+
+// HandlerError 消息处理失败的上报信息
+type HandlerError struct {
+	// ActionKey 消息对应的ActionKey
+	ActionKey int32
+
+	// Err 处理器返回的错误
+	Err error
+
+	// Redeliveries 消息重投递次数
+	// 优先取HeaderRetryCount消息头记录的失败次数，没有该消息头时
+	// 按RabbitMQ的Redelivered标识取0或1
+	Redeliveries int
 }
 
 type MQWrapper struct {
@@ -56,114 +174,170 @@ type MQWrapper struct {
 	// conf 配置
 	conf *Config
 
+	// 当前连接，重连时整体替换，由connMu保护
+	connMu sync.RWMutex
+
 	// MQ实例
 	m *mq.MQ
 
 	// MQ生产者
-	producer *mq.Producer
+	producer publisher
 
-	// MQ消费者
-	consumer *mq.Consumer
+	// MQ消费者，每个消费者绑定对应一个
+	consumers []*mq.Consumer
+
+	// 重新投递失败消息及投递死信的生产者，仅在启用死信时创建
+	retryProducer publisher
 
 	// MQ消息接收通道
 	delivery chan mq.Delivery
 
+	// 连接代数，每次连接成功后加1，用于判断连接是否已被其它调用方重建
+	connGen uint64
+
+	// 连接被替换时关闭，通知消费循环切换到新连接
+	connChanged chan struct{}
+
+	// 连接状态及重连
+	state       int32
+	reconnectMu sync.Mutex
+	dial        func(url string) (*mq.MQ, error)
+	mqUrl       string
+	closeCh     chan struct{}
+
+	// 交换机绑定关系，重连时重新声明
+	exbForProducer []*mq.ExchangeBinds
+	exbForConsumer []*mq.ExchangeBinds
+
 	// MQ消息处理入口
 	handlers map[int32]MsgHandler
 
+	// 可获取消息元数据的处理入口，与handlers互斥
+	handlersEx map[int32]MsgHandlerEx
+
+	// 处理器中间件，按注册顺序由外向内包裹处理器
+	middlewares []Middleware
+
+	// MQ消息观察者，同一ActionKey可有多个，在handlers之后按注册顺序调用
+	observers map[int32][]MsgHandler
+
+	// Any消息按类型名分发的处理入口
+	typeHandlers map[string]TypeHandler
+
 	// MQ编解码器
 	encoder MsgEncoder
 
-	// 消费者控制开关
+	// 发布限速器
+	limiter *tokenBucket
+
+	// 处理器panic熔断器
+	breaker *panicBreaker
+
+	// 限制同时处理消息数目的信号量
+	handleSem chan struct{}
+
+	// 正在处理的消息，Close时等待其完成
+	handling sync.WaitGroup
+
+	// 消费者控制开关，blockConsumeCh仅在暂停期间非空，恢复时关闭
+	pauseMu        sync.Mutex
 	blockConsumeCh chan struct{}
 	stopConsumeCh  chan struct{}
+	consumeDoneCh  chan struct{}
+
+	// 因ErrorSink已满而被丢弃的错误数目
+	droppedHandlerErrors uint64
 }
 
 type MsgHandler func(actionKey int32, msg []byte) error
 
+// Middleware 处理器中间件，用于实现日志、监控、链路追踪等通用逻辑
+type Middleware func(next MsgHandler) MsgHandler
+
+// MsgHandlerEx 可获取消息头等元数据的处理器
+type MsgHandlerEx func(ctx *MsgContext) error
+
+// MsgContext 消息处理上下文
+type MsgContext struct {
+	// ActionKey 消息对应的ActionKey
+	ActionKey int32
+
+	// Body 解码后的消息体
+	Body []byte
+
+	// Delivery 原始消息，包括消息头、是否重新投递、RoutingKey、时间戳等，其中Body为解码前的内容
+	Delivery mq.Delivery
+}
+
+// Header 返回消息头key的值
+func (c *MsgContext) Header(key string) (interface{}, bool) {
+	v, ok := c.Delivery.Headers[key]
+	return v, ok
+}
+
+// publisher 消息发布接口，由mq.Producer实现
+type publisher interface {
+	Publish(exchange, routeKey string, msg *mq.PublishMsg) error
+}
+
+// TypeHandler Any消息的处理器，msg为解包后的具体类型
+type TypeHandler func(msg proto.Message) error
+
+// ActionKeyAny Any消息使用的保留ActionKey
+const ActionKeyAny int32 = math.MinInt32
+
 func New() *MQWrapper {
 	return &MQWrapper{
 		handlers: make(map[int32]MsgHandler),
 		encoder:  DefaultEncoder(),
+		limiter:  newTokenBucket(),
 	}
 }
 
 func (w *MQWrapper) Open(wrapperId string, conf *Config) error {
-	var (
-		err      error
-		queue    *mq.MQ
-		producer *mq.Producer
-		consumer *mq.Consumer
-
-		exbForProducer = []*mq.ExchangeBinds{
-			{
-				Exch: mq.DefaultExchange(conf.ProducerExchange, conf.ProducerExchangeKind),
-				Bindings: []*mq.Binding{
-					{
-						RouteKey: conf.ProducerRouteKey,
-						Queues: []*mq.Queue{
-							mq.DefaultQueue(conf.ProducerQueue),
-						},
-					},
-				},
-			},
-		}
-
-		exbForConsumer = []*mq.ExchangeBinds{
-			{
-				Exch: mq.DefaultExchange(conf.ConsumerExchange, conf.ConsumerExchangeKind),
-				Bindings: []*mq.Binding{
-					{
-						RouteKey: conf.ConsumerRouteKey,
-						Queues: []*mq.Queue{
-							mq.DefaultQueue(conf.ConsumerQueue),
-						},
-					},
-				},
-			},
-		}
-	)
+	var err error
 
 	w.id = wrapperId
 	w.conf = conf
+	w.breaker = newPanicBreaker(conf.PanicBudget, conf.PanicWindow, conf.PanicCooldown)
+	w.exbForProducer = producerExchangeBinds(conf)
+	w.exbForConsumer = consumerExchangeBinds(conf)
+	w.closeCh = make(chan struct{})
+	if w.dial == nil {
+		w.dial = dialMQ
+	}
 
 	// 校验配置
 	if err = w.ValidateConf(conf); err != nil {
 		goto FINISH
 	}
 
-	// 连接MQ
-	if queue, err = mq.New(conf.MQUrl).Open(); err != nil {
-		goto FINISH
-	}
-	w.m = queue
-
-	if conf.EnableProducer {
-		// 新建Producer会话
-		if producer, err = queue.Producer("ProduceTo"); err != nil {
-			goto FINISH
-		}
-		if err = producer.SetExchangeBinds(exbForProducer).Open(); err != nil {
+	if len(conf.EncryptKey) > 0 {
+		if err = w.setEncryption(conf.EncryptKey, conf.EncryptType); err != nil {
 			goto FINISH
 		}
-		w.producer = producer
 	}
 
+	// 连接MQ
+	if w.mqUrl, err = NormalizeMQUrl(conf.MQUrl); err != nil {
+		goto FINISH
+	}
 	if conf.EnableConsumer {
-		// 新建Consumer会话
-		if consumer, err = queue.Consumer("ConsumeFrom"); err != nil {
-			goto FINISH
-		}
-
-		w.delivery = make(chan mq.Delivery, 8)
-		w.stopConsumeCh = make(chan struct{})
-
-		if err = consumer.SetExchangeBinds(exbForConsumer).SetQos(1).SetMsgCallback(w.delivery).Open(); err != nil {
-			goto FINISH
+		concurrency := conf.MaxConcurrency
+		if concurrency <= 0 {
+			concurrency = defaultMaxConcurrency
 		}
-		w.consumer = consumer
+		w.handleSem = make(chan struct{}, concurrency)
+	}
+	if err = w.connect(); err != nil {
+		goto FINISH
+	}
+	atomic.StoreInt32(&w.state, int32(StateConnected))
 
+	if conf.EnableConsumer {
 		// 循环消费
+		w.stopConsumeCh = make(chan struct{})
+		w.consumeDoneCh = make(chan struct{})
 		go w.consumeFromLoop()
 	}
 
@@ -176,8 +350,13 @@ FINISH:
 }
 
 func (w *MQWrapper) Close() error {
-	if w.m != nil {
-		w.m.Close()
+	if w.closeCh != nil {
+		select {
+		case <-w.closeCh:
+			// do nothing
+		default:
+			close(w.closeCh)
+		}
 	}
 	if w.stopConsumeCh != nil {
 		select {
@@ -187,6 +366,21 @@ func (w *MQWrapper) Close() error {
 			close(w.stopConsumeCh)
 		}
 	}
+	// 需要在连接关闭之前完成Nack及正在处理的消息
+	if w.consumeDoneCh != nil {
+		<-w.consumeDoneCh
+		w.waitHandling()
+	}
+	atomic.StoreInt32(&w.state, int32(StateClosed))
+	w.connMu.RLock()
+	m := w.m
+	w.connMu.RUnlock()
+	if m != nil {
+		m.Close()
+	}
+	if c, ok := w.encoder.(MsgEncoderCloser); ok {
+		return c.Close()
+	}
 	return nil
 }
 
@@ -201,23 +395,175 @@ func (w *MQWrapper) RegistActionHandler(actionKey int32, f MsgHandler) error {
 	if _, exist := w.handlers[actionKey]; exist {
 		return fmt.Errorf("Msg handler for '%d' had been existed", actionKey)
 	}
+	if _, exist := w.handlersEx[actionKey]; exist {
+		return fmt.Errorf("Msg handler for '%d' had been existed", actionKey)
+	}
 	w.handlers[actionKey] = f
 	return nil
 }
 
+// RegistActionHandlerEx 注册可获取消息元数据的处理器，与RegistActionHandler共用同一组ActionKey
+func (w *MQWrapper) RegistActionHandlerEx(actionKey int32, f MsgHandlerEx) error {
+	if w.handlersEx == nil {
+		w.handlersEx = make(map[int32]MsgHandlerEx)
+	}
+
+	if f == nil {
+		return fmt.Errorf("Msg handler for '%d' is nil", actionKey)
+	}
+	if _, exist := w.handlers[actionKey]; exist {
+		return fmt.Errorf("Msg handler for '%d' had been existed", actionKey)
+	}
+	if _, exist := w.handlersEx[actionKey]; exist {
+		return fmt.Errorf("Msg handler for '%d' had been existed", actionKey)
+	}
+	w.handlersEx[actionKey] = f
+	return nil
+}
+
+// RegistTypeHandler 按protobuf类型全名(如"google.protobuf.StringValue")注册Any消息的处理器
+// 消息通过PostAny投递，消费时解开Any并分发给对应类型的处理器，
+// 消息类型需已在protobuf注册表中注册(引入生成的pb.go即可)
+func (w *MQWrapper) RegistTypeHandler(typeName string, f TypeHandler) error {
+	if f == nil {
+		return fmt.Errorf("Type handler for '%s' is nil", typeName)
+	}
+	if w.typeHandlers == nil {
+		if err := w.RegistActionHandler(ActionKeyAny, w.dispatchAny); err != nil {
+			return err
+		}
+		w.typeHandlers = make(map[string]TypeHandler)
+	}
+	if _, exist := w.typeHandlers[typeName]; exist {
+		return fmt.Errorf("Type handler for '%s' had been existed", typeName)
+	}
+	w.typeHandlers[typeName] = f
+	return nil
+}
+
+// dispatchAny 解开Any消息并按类型分发
+func (w *MQWrapper) dispatchAny(actionKey int32, msg []byte) error {
+	var a any.Any
+	if err := proto.Unmarshal(msg, &a); err != nil {
+		return fmt.Errorf("Unmarshal Any failed, %v", err)
+	}
+	typeName, err := ptypes.AnyMessageName(&a)
+	if err != nil {
+		return err
+	}
+	h := w.typeHandlers[typeName]
+	if h == nil {
+		return fmt.Errorf("No type handler found for '%s'", typeName)
+	}
+
+	var dyn ptypes.DynamicAny
+	if err = ptypes.UnmarshalAny(&a, &dyn); err != nil {
+		return fmt.Errorf("Unpack Any failed, %v", err)
+	}
+	return h(dyn.Message)
+}
+
+// Use 注册处理器中间件，先注册的中间件位于外层
+// 中间件作用于每一次处理器及观察者的调用，处于panic恢复之内，需在开始消费之前注册
+func (w *MQWrapper) Use(mw Middleware) {
+	if mw != nil {
+		w.middlewares = append(w.middlewares, mw)
+	}
+}
+
+// RegistActionObserver 注册消息观察者，同一ActionKey可注册多个观察者，与RegistActionHandler注册的处理器共存。
+// 收到消息后先调用处理器，再按注册顺序调用各观察者，某个观察者返回错误不影响其余观察者
+func (w *MQWrapper) RegistActionObserver(actionKey int32, f MsgHandler) error {
+	if f == nil {
+		return fmt.Errorf("Msg observer for '%d' is nil", actionKey)
+	}
+	if w.observers == nil {
+		w.observers = make(map[int32][]MsgHandler)
+	}
+	w.observers[actionKey] = append(w.observers[actionKey], f)
+	return nil
+}
+
 func (w *MQWrapper) findHandler(actionKey int32) MsgHandler {
 	return w.handlers[actionKey]
 }
 
 func (w *MQWrapper) Post(actionKey int32, msg []byte, retry int) error {
+	return w.post(context.Background(), "", actionKey, msg, retry, nil)
+}
+
+// PostTo 投递消息到名为binding的生产者绑定，见Config.ProducerBindings
+func (w *MQWrapper) PostTo(binding string, actionKey int32, msg []byte, retry int) error {
+	return w.post(context.Background(), binding, actionKey, msg, retry, nil)
+}
+
+// PostContext 投递消息，失败后每隔1秒重试，直至成功或ctx结束
+// 等待Ready、限流及重试间隔期间ctx结束时立即返回ctx.Err()
+func (w *MQWrapper) PostContext(ctx context.Context, actionKey int32, msg []byte) error {
+	return w.post(ctx, "", actionKey, msg, -1, nil)
+}
+
+// PostAny 将msg包装为google.protobuf.Any投递，由RegistTypeHandler注册的处理器消费
+func (w *MQWrapper) PostAny(msg proto.Message, retry int) error {
+	a, err := ptypes.MarshalAny(msg)
+	if err != nil {
+		return fmt.Errorf("Marshal Any failed, %v", err)
+	}
+	b, err := proto.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("Marshal Any failed, %v", err)
+	}
+	return w.Post(ActionKeyAny, b, retry)
+}
+
+// PostDelayed 投递延迟消息，消息将在delay之后才被路由到队列
+// 要求配置ProducerDelayed
+func (w *MQWrapper) PostDelayed(actionKey int32, msg []byte, delay time.Duration, retry int) error {
+	if w.conf.ProducerDelayed == false {
+		return errors.New("Producer exchange is not delayed, set 'ProducerDelayed' to enable it")
+	}
+	if delay < 0 {
+		return errors.New("Delay must be >= 0")
+	}
+	return w.post(context.Background(), "", actionKey, msg, retry, mq.Table{"x-delay": int64(delay / time.Millisecond)})
+}
+
+// post 投递消息到名为binding的生产者绑定，binding为空表示第一个绑定
+// retry<0表示一直重试直至成功或ctx结束
+func (w *MQWrapper) post(ctx context.Context, binding string, actionKey int32, msg []byte, retry int, headers mq.Table) error {
 	if w.conf.EnableProducer == false {
 		return errors.New("Producer is disabled")
 	}
+	target, err := w.findProducerBinding(binding)
+	if err != nil {
+		return err
+	}
 
-	<-w.conf.Ready
+	select {
+	case <-w.conf.Ready:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 
-	b, err := w.encoder.Encode(actionKey, msg)
-	if err != nil {
+	if w.limiter != nil {
+		if err := w.limiter.wait(ctx); err != nil {
+			return err
+		}
+	}
+
+	var b []byte
+	if he, ok := w.encoder.(HeaderMsgEncoder); ok {
+		var h map[string]interface{}
+		if b, h, err = he.EncodeHeaders(actionKey, msg); err != nil {
+			return err
+		}
+		if len(h) > 0 && headers == nil {
+			headers = make(mq.Table, len(h))
+		}
+		for k, v := range h {
+			headers[k] = v
+		}
+	} else if b, err = w.encoder.Encode(actionKey, msg); err != nil {
 		return err
 	}
 	if w.conf.Debug != nil {
@@ -226,21 +572,87 @@ func (w *MQWrapper) Post(actionKey int32, msg []byte, retry int) error {
 
 	mqMsg := mq.NewPublishMsg(b)
 	mqMsg.ContentType = "application/octet-stream"
+	mqMsg.Headers = headers
 
-	for i := 0; i < retry+1; i++ {
-		err = w.producer.Publish(w.conf.ProducerExchange, w.conf.ProducerRouteKey, mqMsg)
+	timeout := w.conf.PublishTimeout
+	if w.conf.ConfirmMode && timeout <= 0 {
+		timeout = defaultConfirmTimeout
+	}
+
+	for i := 0; retry < 0 || i < retry+1; i++ {
+		w.connMu.RLock()
+		producer, gen := w.producer, w.connGen
+		w.connMu.RUnlock()
+
+		err = publishWithTimeout(timeout, func() error {
+			return producer.Publish(target.Exchange, target.RouteKey, mqMsg)
+		})
 		if err == nil {
 			break
 		}
 		if w.conf.Warn != nil {
 			w.conf.Warn.Println("(%d) Try to post msg to proxy failed, %v", i, err)
 		}
-		time.Sleep(time.Second)
+		// 发布失败通常意味着连接已断开，在后台重连；超时一般是broker流控，被拒绝时连接正常，均无需重连
+		if err != ErrPublishTimeout && err != ErrPublishNack {
+			go w.reconnect(gen)
+		}
+
+		t := time.NewTimer(time.Second)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
 	}
 
 	return err
 }
 
+// confirmPublisher 发布确认模式下包装mq.Producer，将broker的拒绝转换为ErrPublishNack
+// mq.Producer在等待确认时收到nack只返回普通错误，无法与连接断开区分，
+// 不转换时被拒绝的消息会触发不必要的重连
+type confirmPublisher struct {
+	publisher
+}
+
+func (p confirmPublisher) Publish(exchange, routeKey string, msg *mq.PublishMsg) error {
+	err := p.publisher.Publish(exchange, routeKey, msg)
+	if err != nil && isPublishNack(err) {
+		return ErrPublishNack
+	}
+	return err
+}
+
+// isPublishNack 判断Publish返回的错误是否为broker的拒绝
+// mq.Producer未导出nack对应的错误，只能通过错误信息识别
+func isPublishNack(err error) bool {
+	return err == ErrPublishNack || strings.Contains(strings.ToLower(err.Error()), "nack")
+}
+
+// publishWithTimeout 执行publish，超时后返回ErrPublishTimeout
+// 超时后publish仍在后台执行直至返回，无法被中止
+func publishWithTimeout(timeout time.Duration, publish func() error) error {
+	if timeout <= 0 {
+		return publish()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- publish()
+	}()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-t.C:
+		return ErrPublishTimeout
+	}
+}
+
 func (w *MQWrapper) ValidateConf(conf *Config) error {
 	if conf.Ready == nil {
 		return errors.New("Ready flag in config is nil")
@@ -249,71 +661,293 @@ func (w *MQWrapper) ValidateConf(conf *Config) error {
 	if len(conf.MQUrl) <= 0 {
 		return errors.New("Missing 'MQUrl'")
 	}
+	if _, err := NormalizeMQUrl(conf.MQUrl); err != nil {
+		return err
+	}
 
 	if conf.EnableProducer {
-		if len(conf.ProducerExchange) <= 0 {
-			return errors.New("Missing 'ProducerExchange'")
-		}
-		if len(conf.ProducerQueue) <= 0 {
-			return errors.New("Missing 'ProducerQueue'")
-		}
-		if len(conf.ProducerRouteKey) <= 0 {
-			return errors.New("Missing 'ProdicerRoutekey'")
-		}
-		if len(conf.ProducerExchangeKind) <= 0 {
-			return errors.New("Missing 'ProducerExchangeKind'")
+		if err := validateProducerConf(conf); err != nil {
+			return err
 		}
 	}
 
 	if conf.EnableConsumer {
-		if len(conf.ConsumerExchange) <= 0 {
-			return errors.New("Missin 'ConsumerExchange'")
-		}
-		if len(conf.ConsumerQueue) <= 0 {
-			return errors.New("Missing 'ConsumerQueue'")
+		if err := validateConsumerConf(conf); err != nil {
+			return err
 		}
-		if len(conf.ConsumerRouteKey) <= 0 {
-			return errors.New("Missing 'ConsumerRouteKey'")
-		}
-		if len(conf.ConsumerExchangeKind) <= 0 {
-			return errors.New("Missing 'ConsumerExchangeKind'")
+		if conf.MaxRetries > 0 && len(conf.DeadLetterExchange) <= 0 {
+			return errors.New("Missing 'DeadLetterExchange'")
 		}
 	}
 	return nil
 }
 
+// SetPublishRate 设置发布速率限制，perSec<=0表示不限速
+// 超过速率时Post将阻塞等待令牌，burst为允许的最大突发数。
+// 限速作用于每次Post调用而非每次重试，如果启用了发布确认，等待确认的时间不占用令牌
+func (w *MQWrapper) SetPublishRate(perSec float64, burst int) {
+	if w.limiter == nil {
+		w.limiter = newTokenBucket()
+	}
+	w.limiter.set(perSec, burst)
+}
+
+// NormalizeMQUrl 校验并规范化MQUrl
+// 要求scheme为amqp或amqps、host非空，未指定端口时补全默认端口(amqp:5672, amqps:5671)
+func NormalizeMQUrl(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", fmt.Errorf("invalid MQUrl: %v", err)
+	}
+
+	var defaultPort string
+	switch strings.ToLower(u.Scheme) {
+	case "amqp":
+		defaultPort = "5672"
+	case "amqps":
+		defaultPort = "5671"
+	case "":
+		return "", errors.New("invalid MQUrl: missing scheme, expect amqp or amqps")
+	default:
+		return "", fmt.Errorf("invalid MQUrl: unsupported scheme '%s', expect amqp or amqps", u.Scheme)
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+
+	if len(u.Hostname()) <= 0 {
+		return "", errors.New("invalid MQUrl: missing host")
+	}
+	if u.User != nil && len(u.User.Username()) <= 0 {
+		return "", errors.New("invalid MQUrl: missing username in credentials")
+	}
+	if len(u.Port()) <= 0 {
+		u.Host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	return u.String(), nil
+}
+
+// SetEncoder 替换编码器
+// 被替换的编码器不会被关闭，如果它实现了MsgEncoderCloser，需由调用方自行关闭。
+// 配置了EncryptKey时需在Open之前调用，Open时将为其设置密钥
 func (w *MQWrapper) SetEncoder(e MsgEncoder) {
 	if e != nil {
 		w.encoder = e
 	}
 }
 
+// setEncryption 为编码器设置加密密钥，encType为0时使用AES256-GCM
+func (w *MQWrapper) setEncryption(key []byte, encType byte) error {
+	te, ok := w.encoder.(TunableEncoder)
+	if !ok {
+		return errors.New("Encoder doesn't support encryption")
+	}
+	if encType == 0 {
+		encType = cryptolib.TypeAES256GCM
+	}
+	return te.SetEncryption(key, encType)
+}
+
 func (w *MQWrapper) consumeFromLoop() {
-	defer close(w.delivery)
+	defer close(w.consumeDoneCh)
+
+	w.connMu.RLock()
+	delivery, gen, changed := w.delivery, w.connGen, w.connChanged
+	w.connMu.RUnlock()
 
-	<-w.conf.Ready
+	select {
+	case <-w.conf.Ready:
+	case <-w.stopConsumeCh:
+		w.requeuePending(delivery)
+		return
+	}
 
 	for {
+		// 优先响应关闭信号，避免关闭后仍然拉取新消息
+		select {
+		case <-w.stopConsumeCh:
+			w.requeuePending(delivery)
+			return
+		default:
+		}
+
+		// 暂停期间不拉取新消息
+		if !w.waitResume() {
+			w.requeuePending(delivery)
+			return
+		}
+
+		// 达到并发上限时等待正在处理的消息完成后再拉取
+		select {
+		case <-w.stopConsumeCh:
+			w.requeuePending(delivery)
+			return
+		case w.handleSem <- struct{}{}:
+		}
+
 		select {
 		case <-w.stopConsumeCh:
+			<-w.handleSem
+			w.requeuePending(delivery)
 			return
-		case d, ok := <-w.delivery:
+		case <-changed:
+			// 连接已被生产者触发的重连替换
+			<-w.handleSem
+			w.connMu.RLock()
+			delivery, gen, changed = w.delivery, w.connGen, w.connChanged
+			w.connMu.RUnlock()
+			continue
+		case d, ok := <-delivery:
 			if !ok {
+				<-w.handleSem
+				// 连接断开，重连成功后从新连接继续消费
+				if !w.reconnect(gen) {
+					return
+				}
+				w.connMu.RLock()
+				delivery, gen, changed = w.delivery, w.connGen, w.connChanged
+				w.connMu.RUnlock()
+				continue
+			}
+			// 等待拉取期间被暂停时，恢复后再处理已拉取的消息
+			if !w.waitResume() {
+				<-w.handleSem
+				if w.conf.RequeueOnClose {
+					if err := d.Nack(false, true); err != nil && w.conf.Warn != nil {
+						w.conf.Warn.Println("%s: Requeue msg on close failed, %v", w.id, err)
+					}
+				}
+				w.requeuePending(delivery)
 				return
 			}
-			go w.handleMsg(d)
+			w.handling.Add(1)
+			go func() {
+				defer func() {
+					<-w.handleSem
+					w.handling.Done()
+				}()
+				w.handleMsg(d)
+			}()
 		}
 	}
 }
 
+// Pause 暂停消费，不再拉取新消息，连接保持不变，正在处理的消息不受影响
+// 已拉取到本地的消息(最多为预取数)在恢复后处理，可用于下游依赖不可用时的反压
+func (w *MQWrapper) Pause() {
+	w.pauseMu.Lock()
+	if w.blockConsumeCh == nil {
+		w.blockConsumeCh = make(chan struct{})
+	}
+	w.pauseMu.Unlock()
+}
+
+// Resume 恢复被Pause暂停的消费
+func (w *MQWrapper) Resume() {
+	w.pauseMu.Lock()
+	if w.blockConsumeCh != nil {
+		close(w.blockConsumeCh)
+		w.blockConsumeCh = nil
+	}
+	w.pauseMu.Unlock()
+}
+
+// Paused 返回消费是否被暂停
+func (w *MQWrapper) Paused() bool {
+	w.pauseMu.Lock()
+	defer w.pauseMu.Unlock()
+	return w.blockConsumeCh != nil
+}
+
+// waitResume 暂停时等待恢复，返回false表示等待期间消费被停止
+func (w *MQWrapper) waitResume() bool {
+	w.pauseMu.Lock()
+	block := w.blockConsumeCh
+	w.pauseMu.Unlock()
+	if block == nil {
+		return true
+	}
+	select {
+	case <-block:
+		return true
+	case <-w.stopConsumeCh:
+		return false
+	}
+}
+
+// waitHandling 等待正在处理的消息完成，最多等待CloseTimeout
+func (w *MQWrapper) waitHandling() {
+	timeout := w.conf.CloseTimeout
+	if timeout <= 0 {
+		timeout = defaultCloseTimeout
+	}
+
+	done := make(chan struct{})
+	go func() {
+		w.handling.Wait()
+		close(done)
+	}()
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.C:
+		if w.conf.Warn != nil {
+			w.conf.Warn.Println("%s: Wait for handling msgs timeout after %v", w.id, timeout)
+		}
+	}
+}
+
+// requeuePending 将已拉取但尚未处理的消息重新入队
+func (w *MQWrapper) requeuePending(delivery <-chan mq.Delivery) {
+	if w.conf.RequeueOnClose == false {
+		return
+	}
+	for {
+		select {
+		case d, ok := <-delivery:
+			if !ok {
+				return
+			}
+			if err := d.Nack(false, true); err != nil && w.conf.Warn != nil {
+				w.conf.Warn.Println("%s: Requeue msg on close failed, %v", w.id, err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// acknowledger 消息确认接口，由mq.Delivery实现
+type acknowledger interface {
+	Ack(multiple bool) error
+	Nack(multiple, requeue bool) error
+}
+
 func (w *MQWrapper) handleMsg(d mq.Delivery) {
-	defer d.Ack(false)
+	w.handleDelivery(d, d)
+}
+
+// handleDelivery 处理消息并通过acker确认
+func (w *MQWrapper) handleDelivery(d mq.Delivery, acker acknowledger) {
+	ack := true
+	defer func() {
+		if ack {
+			acker.Ack(false)
+		}
+	}()
 
 	if w.conf.Debug != nil {
 		w.conf.Debug.Println("%s receive msg: %#v\nTotal: %d bytes\n", w.id, d.Body, len(d.Body))
 	}
 
-	actionKey, msgBody, err := w.encoder.Decode(d.Body)
+	var actionKey int32
+	var msgBody []byte
+	var err error
+	if he, ok := w.encoder.(HeaderMsgEncoder); ok {
+		actionKey, msgBody, err = he.DecodeHeaders(d.Body, d.Headers)
+	} else {
+		actionKey, msgBody, err = w.encoder.Decode(d.Body)
+	}
 	if err != nil {
 		if w.conf.Warn != nil {
 			w.conf.Warn.Println(err.Error())
@@ -323,13 +957,140 @@ func (w *MQWrapper) handleMsg(d mq.Delivery) {
 
 	//glog.V(5).Infof("%s: Start handle '%s'", w.id, actionKey.String())
 
-	if h := w.findHandler(actionKey); h == nil {
+	if !w.breaker.allow(actionKey) {
+		if w.conf.MaxRetries <= 0 {
+			w.waitBreaker(actionKey)
+		}
+		ack = w.reject(d, acker, actionKey, true)
+		return
+	}
+
+	h, observers := w.findHandler(actionKey), w.observers[actionKey]
+	if hx := w.handlersEx[actionKey]; h == nil && hx != nil {
+		ctx := &MsgContext{ActionKey: actionKey, Body: msgBody, Delivery: d}
+		h = func(int32, []byte) error {
+			return hx(ctx)
+		}
+	}
+	if h == nil && len(observers) <= 0 {
 		if w.conf.Warn != nil {
 			w.conf.Warn.Println("%s: No handler found for action '%d'", w.id, actionKey)
 		}
-	} else {
-		h(actionKey, msgBody)
+		return
+	}
+	if h != nil {
+		if err = w.dispatch(h, actionKey, msgBody, redeliveries(d)); err != nil {
+			ack = w.reject(d, acker, actionKey, w.conf.ManualAck)
+		}
+	}
+	for _, o := range observers {
+		w.dispatch(o, actionKey, msgBody, redeliveries(d))
+	}
+}
+
+// waitBreaker 等待actionKey的熔断结束或消费被停止
+func (w *MQWrapper) waitBreaker(actionKey int32) {
+	d := time.Until(w.breaker.openUntil(actionKey))
+	if d <= 0 {
+		return
 	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-w.stopConsumeCh:
+	}
+}
+
+// reject 处理未能成功处理的消息，返回原消息是否仍需Ack
+// 启用死信时重新投递或进入死信队列，否则requeue为true时Nack并重新入队
+func (w *MQWrapper) reject(d mq.Delivery, acker acknowledger, actionKey int32, requeue bool) bool {
+	if w.conf.MaxRetries > 0 {
+		// 重新投递失败时退回到重新入队，避免消息丢失
+		err := w.retryOrDeadLetter(d)
+		if err == nil {
+			return true
+		}
+		requeue = true
+		if w.conf.Warn != nil {
+			w.conf.Warn.Println("%s: Retry msg for action '%d' failed, %v", w.id, actionKey, err)
+		}
+	}
+	if !requeue {
+		return true
+	}
+	if err := acker.Nack(false, true); err != nil && w.conf.Warn != nil {
+		w.conf.Warn.Println("%s: Nack msg for action '%d' failed, %v", w.id, actionKey, err)
+	}
+	return false
+}
+
+// dispatch 调用处理器并记录、上报其返回的错误
+func (w *MQWrapper) dispatch(h MsgHandler, actionKey int32, msgBody []byte, redeliveries int) error {
+	for i := len(w.middlewares) - 1; i >= 0; i-- {
+		h = w.middlewares[i](h)
+	}
+	err := w.callHandler(h, actionKey, msgBody)
+	if err != nil {
+		if w.conf.Warn != nil {
+			w.conf.Warn.Println("%s: Handle action '%d' failed, %v", w.id, actionKey, err)
+		}
+		w.reportHandlerError(actionKey, err, redeliveries)
+	}
+	return err
+}
+
+// callHandler 调用处理器，处理器panic时将其转换为错误并计入熔断器
+func (w *MQWrapper) callHandler(h MsgHandler, actionKey int32, msgBody []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panic: %v", r)
+			if w.conf.Error != nil {
+				w.conf.Error.Println("%s: Handler for action '%d' panic, %v\n%s", w.id, actionKey, r, debug.Stack())
+			}
+			if w.breaker.recordPanic(actionKey) && w.conf.Error != nil {
+				w.conf.Error.Println("%s: Handler for action '%d' panic too many times, disabled for %v", w.id, actionKey, w.breaker.cooldown)
+			}
+		}
+	}()
+	return h(actionKey, msgBody)
+}
+
+// reportHandlerError 将处理器错误非阻塞地投递至ErrorSink
+func (w *MQWrapper) reportHandlerError(actionKey int32, err error, redeliveries int) {
+	if w.conf.ErrorSink == nil {
+		return
+	}
+
+	herr := HandlerError{
+		ActionKey:    actionKey,
+		Err:          err,
+		Redeliveries: redeliveries,
+	}
+
+	select {
+	case w.conf.ErrorSink <- herr:
+	default:
+		atomic.AddUint64(&w.droppedHandlerErrors, 1)
+	}
+}
+
+// redeliveries 返回消息的重投递次数
+func redeliveries(d mq.Delivery) int {
+	if v, ok := d.Headers[HeaderRetryCount]; ok {
+		if n, err := parseInt32Header(HeaderRetryCount, v); err == nil && n >= 0 {
+			return int(n)
+		}
+	}
+	if d.Redelivered {
+		return 1
+	}
+	return 0
+}
+
+// DroppedHandlerErrors 返回因ErrorSink已满而被丢弃的错误数目
+func (w *MQWrapper) DroppedHandlerErrors() uint64 {
+	return atomic.LoadUint64(&w.droppedHandlerErrors)
 }
 
 type LogWriter interface {
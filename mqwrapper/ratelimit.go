@@ -0,0 +1,107 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqwrapper
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenBucket 令牌桶限速器
+// rate <= 0 时表示不限速
+type tokenBucket struct {
+	mutex sync.Mutex
+
+	// 每秒产生的令牌数
+	rate float64
+
+	// 桶容量，即允许的最大突发数
+	burst float64
+
+	// 当前可用令牌数，为负数时表示已被预支
+	tokens float64
+
+	// 上一次补充令牌的时间
+	last time.Time
+}
+
+func newTokenBucket() *tokenBucket {
+	return &tokenBucket{}
+}
+
+func (b *tokenBucket) set(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+
+	b.mutex.Lock()
+	b.rate = rate
+	b.burst = float64(burst)
+	b.tokens = float64(burst)
+	b.last = time.Now()
+	b.mutex.Unlock()
+}
+
+// reserve 取走一个令牌，返回需要等待的时长
+func (b *tokenBucket) reserve() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel 归还一个未使用的令牌
+func (b *tokenBucket) cancel() {
+	b.mutex.Lock()
+	if b.rate > 0 {
+		b.tokens++
+	}
+	b.mutex.Unlock()
+}
+
+// wait 阻塞直到获取一个令牌或者ctx结束
+func (b *tokenBucket) wait(ctx context.Context) error {
+	d := b.reserve()
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqwrapper
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// 裸编码模式下使用的消息头
+const (
+	// HeaderActionKey 携带ActionKey的消息头
+	HeaderActionKey = "x-action-key"
+
+	// HeaderContentEncoding 消息体被压缩时携带压缩方式的消息头，目前仅支持gzip
+	HeaderContentEncoding = "x-content-encoding"
+)
+
+// HeaderMsgEncoder 借助AMQP消息头传递元数据的编码器
+// MQWrapper在投递和消费时优先使用EncodeHeaders/DecodeHeaders
+type HeaderMsgEncoder interface {
+	MsgEncoder
+	EncodeHeaders(actionKey int32, msgBody []byte) (b []byte, headers map[string]interface{}, err error)
+	DecodeHeaders(b []byte, headers map[string]interface{}) (actionKey int32, msgBody []byte, err error)
+}
+
+// RawEncoder 裸编码器，消息体直接作为AMQP消息体投递，没有魔数及长度等帧头，
+// ActionKey放在x-action-key消息头中，便于与无法解析帧头的外部系统互通。
+// 代价是消息不再自描述：脱离消息头后无法得知ActionKey及是否压缩，
+// 因此收发两端必须都使用RawEncoder(或遵循相同的消息头约定)。
+type RawEncoder struct {
+	// CompressThreshold 超过该长度的消息体将使用gzip压缩，<=0表示不压缩
+	CompressThreshold int
+}
+
+// NewRawEncoder 返回裸编码器，compressThreshold<=0表示不压缩
+func NewRawEncoder(compressThreshold int) MsgEncoder {
+	return &RawEncoder{CompressThreshold: compressThreshold}
+}
+
+// Encode 裸编码需要通过消息头携带ActionKey，不支持单独使用
+func (e *RawEncoder) Encode(actionKey int32, msgBody []byte) ([]byte, error) {
+	return nil, errors.New("RawEncoder requires message headers, use EncodeHeaders")
+}
+
+// Decode 裸编码需要通过消息头携带ActionKey，不支持单独使用
+func (e *RawEncoder) Decode(b []byte) (int32, []byte, error) {
+	return 0, nil, errors.New("RawEncoder requires message headers, use DecodeHeaders")
+}
+
+func (e *RawEncoder) EncodeHeaders(actionKey int32, msgBody []byte) ([]byte, map[string]interface{}, error) {
+	headers := map[string]interface{}{
+		HeaderActionKey: actionKey,
+	}
+	if e.CompressThreshold > 0 && len(msgBody) > e.CompressThreshold {
+		compressed, err := Compress(msgBody)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Compress msg body failed, %v", err)
+		}
+		msgBody = compressed
+		headers[HeaderContentEncoding] = "gzip"
+	}
+	return msgBody, headers, nil
+}
+
+func (e *RawEncoder) DecodeHeaders(b []byte, headers map[string]interface{}) (actionKey int32, msgBody []byte, err error) {
+	v, ok := headers[HeaderActionKey]
+	if !ok {
+		return 0, nil, fmt.Errorf("Missing '%s' header", HeaderActionKey)
+	}
+	if actionKey, err = parseActionKey(v); err != nil {
+		return 0, nil, err
+	}
+
+	switch headers[HeaderContentEncoding] {
+	case nil, "":
+		return actionKey, b, nil
+	case "gzip":
+		if msgBody, err = Decompress(b); err != nil {
+			return 0, nil, fmt.Errorf("Decompress msg body failed, %v", err)
+		}
+		return actionKey, msgBody, nil
+	default:
+		return 0, nil, fmt.Errorf("Unsupported content encoding '%v'", headers[HeaderContentEncoding])
+	}
+}
+
+// parseActionKey 解析消息头中的ActionKey，外部系统写入的整数类型可能不同，统一转换为int32
+func parseActionKey(v interface{}) (int32, error) {
+	return parseInt32Header(HeaderActionKey, v)
+}
+
+// parseInt32Header 将消息头key的值v转换为int32
+func parseInt32Header(key string, v interface{}) (int32, error) {
+	var n int64
+	switch k := v.(type) {
+	case int32:
+		return k, nil
+	case int8:
+		n = int64(k)
+	case int16:
+		n = int64(k)
+	case int:
+		n = int64(k)
+	case int64:
+		n = k
+	case string:
+		var err error
+		if n, err = strconv.ParseInt(k, 10, 32); err != nil {
+			return 0, fmt.Errorf("Bad '%s' header, %v", key, err)
+		}
+	default:
+		return 0, fmt.Errorf("Bad '%s' header type %T", key, v)
+	}
+	if int64(int32(n)) != n {
+		return 0, fmt.Errorf("'%s' header %d overflows int32", key, n)
+	}
+	return int32(n), nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2018 Hurricanezwf. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mqwrapper
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/Hurricanezwf/rabbitmq-go/mq"
+)
+
+// State 连接状态
+type State int32
+
+const (
+	StateClosed State = iota
+	StateConnected
+	StateReconnecting
+)
+
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	default:
+		return fmt.Sprintf("State(%d)", int32(s))
+	}
+}
+
+// 默认的重连间隔
+const (
+	defaultReconnectInterval    = time.Second
+	defaultMaxReconnectInterval = 30 * time.Second
+)
+
+// State 返回当前的连接状态
+func (w *MQWrapper) State() State {
+	return State(atomic.LoadInt32(&w.state))
+}
+
+func dialMQ(url string) (*mq.MQ, error) {
+	return mq.New(url).Open()
+}
+
+// connect 连接MQ，声明交换机绑定并创建生产者、消费者，成功后替换当前连接
+func (w *MQWrapper) connect() (err error) {
+	queue, err := w.dial(w.mqUrl)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			queue.Close()
+		}
+	}()
+
+	var (
+		producer      *mq.Producer
+		retryProducer *mq.Producer
+		consumers     []*mq.Consumer
+		delivery      chan mq.Delivery
+	)
+
+	if w.conf.EnableProducer {
+		// 新建Producer会话
+		if producer, err = queue.Producer("ProduceTo"); err != nil {
+			return err
+		}
+		if len(w.exbForProducer) > 0 {
+			producer.SetExchangeBinds(w.exbForProducer)
+		}
+		if w.conf.ConfirmMode {
+			producer.Confirm(true)
+		}
+		if err = producer.Open(); err != nil {
+			if w.conf.ProducerDelayed {
+				err = fmt.Errorf("Declare delayed exchange failed, make sure the rabbitmq_delayed_message_exchange plugin is enabled, %v", err)
+			}
+			return err
+		}
+	}
+
+	if w.conf.EnableConsumer {
+		if w.conf.MaxRetries > 0 {
+			// 失败消息的重新投递及死信投递，交换机由消费者及运维负责声明
+			if retryProducer, err = queue.Producer("RetryTo"); err != nil {
+				return err
+			}
+			if err = retryProducer.Open(); err != nil {
+				return err
+			}
+		}
+		// 每个绑定新建一个Consumer会话，共用同一个接收通道，预取数与并发上限保持一致
+		delivery = make(chan mq.Delivery, 8)
+		for i, exb := range w.exbForConsumer {
+			var consumer *mq.Consumer
+			if consumer, err = queue.Consumer(consumerName(i)); err != nil {
+				return err
+			}
+			if err = consumer.SetExchangeBinds([]*mq.ExchangeBinds{exb}).SetQos(cap(w.handleSem)).SetMsgCallback(delivery).Open(); err != nil {
+				return err
+			}
+			consumers = append(consumers, consumer)
+		}
+	}
+
+	w.connMu.Lock()
+	w.m, w.consumers, w.delivery = queue, consumers, delivery
+	w.producer, w.retryProducer = nil, nil
+	if producer != nil {
+		w.producer = producer
+		if w.conf.ConfirmMode {
+			w.producer = confirmPublisher{producer}
+		}
+	}
+	if retryProducer != nil {
+		w.retryProducer = retryProducer
+	}
+	w.connGen++
+	if w.connChanged != nil {
+		close(w.connChanged)
+	}
+	w.connChanged = make(chan struct{})
+	w.connMu.Unlock()
+	return nil
+}
+
+// reconnect 在连接断开后以指数退避的方式重连，直至成功或Close，返回是否重连成功
+// gen为调用方发现连接断开时的连接代数，若连接已被其它调用方重建则直接返回
+func (w *MQWrapper) reconnect(gen uint64) bool {
+	w.reconnectMu.Lock()
+	defer w.reconnectMu.Unlock()
+
+	w.connMu.RLock()
+	old, cur := w.m, w.connGen
+	w.connMu.RUnlock()
+	if cur != gen {
+		return true
+	}
+
+	select {
+	case <-w.closeCh:
+		return false
+	default:
+	}
+
+	atomic.StoreInt32(&w.state, int32(StateReconnecting))
+	if old != nil {
+		old.Close()
+	}
+
+	interval, maxInterval := w.conf.ReconnectInterval, w.conf.MaxReconnectInterval
+	if interval <= 0 {
+		interval = defaultReconnectInterval
+	}
+	if maxInterval <= 0 {
+		maxInterval = defaultMaxReconnectInterval
+	}
+	if interval > maxInterval {
+		interval = maxInterval
+	}
+
+	for i := 1; ; i++ {
+		t := time.NewTimer(interval)
+		select {
+		case <-w.closeCh:
+			t.Stop()
+			return false
+		case <-t.C:
+		}
+
+		err := w.connect()
+		if err == nil {
+			// 重连期间被关闭时释放新建立的连接
+			select {
+			case <-w.closeCh:
+				w.connMu.RLock()
+				w.m.Close()
+				w.connMu.RUnlock()
+				return false
+			default:
+			}
+			atomic.StoreInt32(&w.state, int32(StateConnected))
+			if w.conf.Info != nil {
+				w.conf.Info.Println("%s: Reconnect to mq success after %d attempts", w.id, i)
+			}
+			return true
+		}
+		if w.conf.Warn != nil {
+			w.conf.Warn.Println("%s: (%d) Reconnect to mq failed, %v", w.id, i, err)
+		}
+		if interval *= 2; interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}